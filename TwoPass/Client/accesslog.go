@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Access Log
+// ============================================================================
+//
+// With -access-log every tunnel produces one JSON line when it ends, carrying
+// what billing and troubleshooting need without the debug log:
+//
+//   {"time":"...","session":"k3x9qa","client":"127.0.0.1:50122",
+//    "target":"example.com:443","protocol":"v2","upstream":"cf",
+//    "http_post":"h2","http_get":"h2","post_status":201,"get_status":200,
+//    "bytes_up":5120,"bytes_down":1048576,"setup_ms":84.2,
+//    "duration_ms":1532.7,"close_reason":"completed"}
+//
+// Like the metrics, the log is shared by every proxy generation.
+
+// Close reasons, from the first event that ended the tunnel.
+const (
+	closeCompleted      = "completed"       // the data stream ended normally
+	closeClient         = "client_closed"   // the client went away
+	closeTimeout        = "timeout"         // -stream-timeout elapsed
+	closeStreamError    = "stream_error"    // relaying failed after setup
+	closeUpstreamError  = "upstream_error"  // no response from the upstream
+	closeUpstreamStatus = "upstream_status" // the upstream rejected the tunnel
+	closeAdmin          = "admin"           // closed through the admin API
+	closeShutdown       = "shutdown"        // cancelled at the drain timeout
+)
+
+type accessRecord struct {
+	Time        time.Time `json:"time"`
+	Session     string    `json:"session"`
+	Client      string    `json:"client"`
+	Target      string    `json:"target"`
+	Protocol    string    `json:"protocol"`
+	Upstream    string    `json:"upstream,omitempty"`
+	HTTPPOST    string    `json:"http_post,omitempty"`
+	HTTPGET     string    `json:"http_get,omitempty"`
+	StatusPOST  int       `json:"post_status,omitempty"`
+	StatusGET   int       `json:"get_status,omitempty"`
+	BytesUp     uint64    `json:"bytes_up"`
+	BytesDown   uint64    `json:"bytes_down"`
+	SetupMS     float64   `json:"setup_ms,omitempty"`
+	DurationMS  float64   `json:"duration_ms"`
+	CloseReason string    `json:"close_reason"`
+}
+
+type accessLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// newAccessLog writes to stdout for "-", otherwise to path, rotating it once
+// it would grow beyond maxSize bytes and keeping maxBackups old files.
+func newAccessLog(path string, maxSize int64, maxBackups int) (*accessLog, error) {
+	if path == "-" {
+		return &accessLog{w: nopCloser{os.Stdout}}, nil
+	}
+	f, err := openRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{w: f}, nil
+}
+
+func (l *accessLog) write(t *liveTunnel) {
+	t.mu.Lock()
+	rec := accessRecord{
+		Time:        time.Now(),
+		Session:     t.id,
+		Client:      t.client,
+		Target:      t.target,
+		Protocol:    t.protocol,
+		Upstream:    t.upstream,
+		HTTPPOST:    t.httpPOST,
+		HTTPGET:     t.httpGET,
+		StatusPOST:  t.statusPOST,
+		StatusGET:   t.statusGET,
+		BytesUp:     t.bytesUp.Load(),
+		BytesDown:   t.bytesDown.Load(),
+		SetupMS:     milliseconds(t.setup),
+		CloseReason: t.closeReason,
+	}
+	t.mu.Unlock()
+	rec.DurationMS = milliseconds(rec.Time.Sub(t.started))
+	if rec.CloseReason == "" {
+		rec.CloseReason = closeCompleted
+	}
+
+	line, _ := json.Marshal(rec)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write access log", "error", err)
+	}
+}
+
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// ============================================================================
+// Tunnel Events
+// ============================================================================
+
+type tunnelKey struct{}
+
+// tunnelFrom returns the tunnel stored in ctx by openTunnel, or nil for
+// requests that belong to no single tunnel, such as mux sessions. Every
+// recording method accepts a nil tunnel.
+func tunnelFrom(ctx context.Context) *liveTunnel {
+	t, _ := ctx.Value(tunnelKey{}).(*liveTunnel)
+	return t
+}
+
+// recordResponse notes the HTTP version and status of an upstream response.
+func (t *liveTunnel) recordResponse(method, httpVersion string, status int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if method == "GET" {
+		t.httpGET, t.statusGET = httpVersion, status
+	} else {
+		t.httpPOST, t.statusPOST = httpVersion, status
+	}
+}
+
+// useHTTP notes the HTTP versions of a tunnel without per-tunnel requests.
+func (t *liveTunnel) useHTTP(post, get string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.httpPOST, t.httpGET = post, get
+}
+
+// established records the setup latency the first time it is called.
+func (t *liveTunnel) established() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.setup == 0 {
+		t.setup = time.Since(t.started)
+	}
+}
+
+// closing records why the tunnel ends; the first reason wins.
+func (t *liveTunnel) closing(reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closeReason == "" {
+		t.closeReason = reason
+	}
+}
+
+// closeReasonFor classifies the error that ended relaying.
+func closeReasonFor(err error) string {
+	switch {
+	case err == nil:
+		return closeCompleted
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return closeTimeout
+	case isExpectedError(err):
+		return closeClient
+	default:
+		return closeStreamError
+	}
+}
+
+// upstreamErrorReason classifies a failed upstream request.
+func upstreamErrorReason(err error) string {
+	if reason := closeReasonFor(err); reason != closeStreamError {
+		return reason
+	}
+	return closeUpstreamError
+}
+
+// ============================================================================
+// Rotating File
+// ============================================================================
+
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open access log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open access log: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write is called with the accessLog lock held.
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.1 .. path.N up by one, dropping the oldest, and moves
+// the current file to path.1. With no backups the file is truncated. The
+// current file is only closed once its replacement is open, so a failed
+// rotation leaves it in place for the next attempt.
+func (r *rotatingFile) rotate() error {
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("rotate access log: %w", err)
+		}
+	} else if err := os.Truncate(r.path, 0); err != nil {
+		return fmt.Errorf("rotate access log: %w", err)
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readLog returns the contents of a log file, or "<missing>".
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "<missing>"
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		want       map[string]string
+	}{
+		{
+			name:       "backups",
+			maxBackups: 2,
+			want:       map[string]string{"": "dddd\n", ".1": "cccc\n", ".2": "bbbb\n", ".3": "<missing>"},
+		},
+		{
+			name: "truncate",
+			want: map[string]string{"": "dddd\n", ".1": "<missing>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			r, err := openRotatingFile(path, 8, tt.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n"} {
+				if _, err := r.Write([]byte(line)); err != nil {
+					t.Fatalf("Write(%q) = %v", line, err)
+				}
+			}
+			for suffix, want := range tt.want {
+				if got := readLog(t, path+suffix); got != want {
+					t.Errorf("access.log%s = %q, want %q", suffix, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(path, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Write([]byte("aaaa\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A non-empty directory in the way of access.log.1 fails the rename.
+	if err := os.MkdirAll(filepath.Join(path+".1", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("bbbb\n")); err == nil {
+		t.Fatal("Write succeeded although the rotation failed")
+	}
+	if _, err := r.f.Stat(); err != nil {
+		t.Fatalf("the failed rotation closed the current file: %v", err)
+	}
+
+	// Once the obstacle is gone, the next write rotates.
+	if err := os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Write([]byte("cccc\n")); err != nil {
+		t.Fatalf("Write after the failed rotation = %v", err)
+	}
+	if got := readLog(t, path+".1"); got != "aaaa\n" {
+		t.Errorf("access.log.1 = %q, want %q", got, "aaaa\n")
+	}
+	if got := readLog(t, path); got != "cccc\n" {
+		t.Errorf("access.log = %q, want %q", got, "cccc\n")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// Admin API
+// ============================================================================
+//
+// A small JSON API for operating a running client:
+//
+//   GET    /tunnels          list open tunnels
+//   DELETE /tunnels/{id}     close one tunnel
+//   GET    /upstreams        upstream health and the pinned upstream
+//   PUT    /upstreams/active pin an upstream: {"name": "cf"}
+//   DELETE /upstreams/active return to the -upstream-policy
+//
+// Every request needs "Authorization: Bearer <admin token>". Like the metrics
+// endpoint, the server is shared by all proxy generations; it always acts on
+// the current one, so a pin survives a reload.
+
+type tunnelInfo struct {
+	ID         string    `json:"id"`
+	Client     string    `json:"client"`
+	Target     string    `json:"target"`
+	Protocol   string    `json:"protocol"`
+	Upstream   string    `json:"upstream,omitempty"`
+	BytesUp    uint64    `json:"bytes_up"`
+	BytesDown  uint64    `json:"bytes_down"`
+	Started    time.Time `json:"started"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+type upstreamInfo struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	LatencyMS float64 `json:"latency_ms"`
+	LastError string  `json:"last_error,omitempty"`
+	Pinned    bool    `json:"pinned"`
+}
+
+type upstreamsInfo struct {
+	Policy    string         `json:"policy"`
+	Pinned    string         `json:"pinned,omitempty"`
+	Upstreams []upstreamInfo `json:"upstreams"`
+}
+
+// startAdmin serves the admin API on addr.
+func (p *Proxy) startAdmin(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", p.adminListTunnels)
+	mux.HandleFunc("DELETE /tunnels/{id}", p.adminCloseTunnel)
+	mux.HandleFunc("GET /upstreams", p.adminListUpstreams)
+	mux.HandleFunc("PUT /upstreams/active", p.adminPinUpstream)
+	mux.HandleFunc("DELETE /upstreams/active", p.adminUnpinUpstream)
+
+	server := &http.Server{Addr: addr, Handler: p.requireAdminToken(mux)}
+	p.addServer(server)
+	if host, _, _ := net.SplitHostPort(addr); !isLoopbackHost(host) {
+		slog.Warn("Admin API is reachable beyond localhost", "addr", addr)
+	}
+	slog.Info("Serving admin API", "url", "http://"+addr)
+	return server.ListenAndServe()
+}
+
+// requireAdminToken rejects requests without the current admin token, which
+// is re-read from each generation so a reload can rotate it.
+func (p *Proxy) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		want := p.current().config.AdminToken
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			slog.Warn("Unauthorized admin request", "client", r.RemoteAddr)
+			adminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) adminListTunnels(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	tunnels := []tunnelInfo{}
+	for _, t := range p.tunnels.list() {
+		tunnels = append(tunnels, tunnelInfo{
+			ID:         t.id,
+			Client:     t.client,
+			Target:     t.target,
+			Protocol:   t.protocol,
+			Upstream:   t.upstream,
+			BytesUp:    t.bytesUp.Load(),
+			BytesDown:  t.bytesDown.Load(),
+			Started:    t.started,
+			AgeSeconds: now.Sub(t.started).Seconds(),
+		})
+	}
+	adminJSON(w, http.StatusOK, tunnels)
+}
+
+func (p *Proxy) adminCloseTunnel(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !p.tunnels.closeTunnel(id) {
+		adminError(w, http.StatusNotFound, "no such tunnel")
+		return
+	}
+	slog.Info("Tunnel closed through the admin API", "session", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminListUpstreams(w http.ResponseWriter, r *http.Request) {
+	pool := p.current().upstreams
+	info := upstreamsInfo{Policy: pool.policy, Pinned: pool.pinnedName(), Upstreams: []upstreamInfo{}}
+	for _, up := range pool.upstreams {
+		up.mu.Lock()
+		info.Upstreams = append(info.Upstreams, upstreamInfo{
+			Name:      up.config.Name,
+			Healthy:   up.healthy,
+			LatencyMS: float64(up.latency) / float64(time.Millisecond),
+			LastError: up.lastError,
+			Pinned:    up.config.Name == info.Pinned,
+		})
+		up.mu.Unlock()
+	}
+	adminJSON(w, http.StatusOK, info)
+}
+
+func (p *Proxy) adminPinUpstream(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil || body.Name == "" {
+		adminError(w, http.StatusBadRequest, `expected {"name": "<upstream>"}`)
+		return
+	}
+	if err := p.current().upstreams.pin(body.Name); err != nil {
+		adminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	slog.Info("New tunnels now use the upstream pinned through the admin API", "upstream", body.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Proxy) adminUnpinUpstream(w http.ResponseWriter, r *http.Request) {
+	pool := p.current().upstreams
+	pool.pin("")
+	slog.Info("Upstream pin removed, returning to the selection policy", "policy", pool.policy)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, message string) {
+	adminJSON(w, status, map[string]string{"error": message})
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+// signedTunnelRequest returns a request as the server receives it, signed by
+// the client for its target and session headers.
+func signedTunnelRequest(method, target string, header map[string]string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	signRequest(r, testToken)
+	return r
+}
+
+// hmacHeader builds an Authorization header for r with a chosen timestamp.
+func hmacHeader(token string, r *http.Request, ts time.Time, nonce string) string {
+	unix := strconv.FormatInt(ts.Unix(), 10)
+	sig := signature(token, r.Method, signedPath(r.URL), r.Header.Get("X-Target-Host"), r.Header.Get("X-Target-Port"), r.Header.Get("X-Session-ID"),
+		r.Header.Get(seqHeader), r.Header.Get(offsetHeader), unix, nonce)
+	return fmt.Sprintf("%s ts=%s,nonce=%s,sig=%s", hmacScheme, unix, nonce, sig)
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	header := map[string]string{
+		"X-Target-Host": "example.com",
+		"X-Target-Port": "443",
+		"X-Session-ID":  "abc123",
+		seqHeader:       "3",
+	}
+	signed := func() *http.Request { return signedTunnelRequest("POST", "/tunnel", header) }
+	withHeader := func(key, value string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set(key, value) }
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		request func() *http.Request
+		mutate  func(*http.Request)
+		wantErr error
+	}{
+		{name: "hmac", mode: authHMAC, request: signed},
+		{name: "hmac accepted by any", mode: authAny, request: signed},
+		{name: "hmac rejected by basic", mode: authBasic, request: signed, wantErr: errAuthMissing},
+		{
+			name: "get with offset", mode: authHMAC,
+			request: func() *http.Request {
+				return signedTunnelRequest("GET", "/tunnel", map[string]string{"X-Session-ID": "abc123", offsetHeader: "65536"})
+			},
+		},
+		{
+			name: "root path", mode: authHMAC,
+			request: func() *http.Request { return signedTunnelRequest("POST", "http://example.com", header) },
+		},
+
+		{name: "wrong token", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: func(r *http.Request) {
+			r.Header.Set("Authorization", hmacHeader("other", r, time.Now(), "00ff"))
+		}},
+		{name: "method changed", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: func(r *http.Request) { r.Method = "GET" }},
+		{name: "path changed", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: func(r *http.Request) { r.URL.Path = "/other" }},
+		{name: "target host changed", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: withHeader("X-Target-Host", "evil.example")},
+		{name: "target port changed", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: withHeader("X-Target-Port", "22")},
+		{name: "session changed", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: withHeader("X-Session-ID", "other")},
+		{name: "seq changed", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: withHeader(seqHeader, "4")},
+		{name: "offset added", mode: authHMAC, request: signed, wantErr: errAuthInvalid, mutate: withHeader(offsetHeader, "0")},
+
+		{name: "expired", mode: authHMAC, request: signed, wantErr: errAuthExpired, mutate: func(r *http.Request) {
+			r.Header.Set("Authorization", hmacHeader(testToken, r, time.Now().Add(-2*time.Minute), "01"))
+		}},
+		{name: "from the future", mode: authHMAC, request: signed, wantErr: errAuthExpired, mutate: func(r *http.Request) {
+			r.Header.Set("Authorization", hmacHeader(testToken, r, time.Now().Add(2*time.Minute), "02"))
+		}},
+		{name: "inside the window", mode: authHMAC, request: signed, mutate: func(r *http.Request) {
+			r.Header.Set("Authorization", hmacHeader(testToken, r, time.Now().Add(-30*time.Second), "03"))
+		}},
+
+		{name: "missing", mode: authAny, request: signed, wantErr: errAuthMissing, mutate: func(r *http.Request) { r.Header.Del("Authorization") }},
+		{name: "unknown scheme", mode: authAny, request: signed, wantErr: errAuthMissing, mutate: withHeader("Authorization", "Bearer "+testToken)},
+		{name: "missing nonce", mode: authHMAC, request: signed, wantErr: errAuthMissing, mutate: withHeader("Authorization", hmacScheme+" ts=1,sig=x")},
+		{name: "bad timestamp", mode: authHMAC, request: signed, wantErr: errAuthMissing, mutate: withHeader("Authorization", hmacScheme+" ts=now,nonce=01,sig=x")},
+
+		{name: "basic", mode: authBasic, request: signed, mutate: withHeader("Authorization", "Basic "+testToken)},
+		{name: "basic accepted by any", mode: authAny, request: signed, mutate: withHeader("Authorization", "Basic "+testToken)},
+		{name: "basic rejected by hmac", mode: authHMAC, request: signed, wantErr: errAuthMissing, mutate: withHeader("Authorization", "Basic "+testToken)},
+		{name: "basic wrong token", mode: authBasic, request: signed, wantErr: errAuthInvalid, mutate: withHeader("Authorization", "Basic other")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAuthenticator(testToken, tt.mode, time.Minute)
+			r := tt.request()
+			if tt.mutate != nil {
+				tt.mutate(r)
+			}
+			if err := a.verify(r); !errors.Is(err, tt.wantErr) {
+				t.Errorf("verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorReplay(t *testing.T) {
+	a := newAuthenticator(testToken, authHMAC, time.Minute)
+	r := signedTunnelRequest("POST", "/tunnel", map[string]string{"X-Session-ID": "abc123", seqHeader: "0"})
+
+	if err := a.verify(r); err != nil {
+		t.Fatalf("first verify = %v, want nil", err)
+	}
+	if err := a.verify(r); !errors.Is(err, errAuthReplayed) {
+		t.Errorf("replayed verify = %v, want %v", err, errAuthReplayed)
+	}
+
+	// A fresh signature of the same request has a new nonce.
+	signRequest(r, testToken)
+	if err := a.verify(r); err != nil {
+		t.Errorf("re-signed verify = %v, want nil", err)
+	}
+}
+
+func TestHMACSignerSignsEachSend(t *testing.T) {
+	a := newAuthenticator(testToken, authHMAC, time.Minute)
+	var verified []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := a.verify(r); err != nil {
+			t.Errorf("%s: %v", r.URL.Path, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		verified = append(verified, r.URL.Path)
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/tunnel", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: hmacSigner{ts.Client().Transport, testToken}}
+	req, err := http.NewRequest("GET", ts.URL+"/old", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Session-ID", "abc123")
+	req.Header.Set(offsetHeader, "0")
+
+	// The redirect and the resent request are signed again, not replayed.
+	for range 2 {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	if want := "[/old /tunnel /old /tunnel]"; fmt.Sprint(verified) != want {
+		t.Errorf("verified %v, want %s", verified, want)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Error("hmacSigner modified the caller's request")
+	}
+}
+
+func TestAuthenticatorNoncePruning(t *testing.T) {
+	a := newAuthenticator(testToken, authHMAC, time.Minute)
+	start := time.Now()
+
+	tests := []struct {
+		name    string
+		nonce   string
+		expiry  time.Time
+		now     time.Time
+		wantErr error
+	}{
+		{name: "first use", nonce: "a", expiry: start.Add(time.Minute), now: start},
+		{name: "replay before expiry", nonce: "a", expiry: start.Add(time.Minute), now: start.Add(30 * time.Second), wantErr: errAuthReplayed},
+		{name: "other nonce", nonce: "b", expiry: start.Add(3 * time.Minute), now: start.Add(30 * time.Second)},
+		// Past the window since the last prune, so expired nonces are dropped.
+		{name: "reuse after expiry", nonce: "a", expiry: start.Add(4 * time.Minute), now: start.Add(2 * time.Minute)},
+		{name: "unexpired nonce kept", nonce: "b", expiry: start.Add(4 * time.Minute), now: start.Add(2 * time.Minute), wantErr: errAuthReplayed},
+	}
+	for _, tt := range tests {
+		if err := a.useNonce(tt.nonce, tt.expiry, tt.now); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: useNonce = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if len(a.nonces) != 2 {
+		t.Errorf("%d nonces recorded, want 2", len(a.nonces))
+	}
+}
+
+func TestSignedPath(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com", "/"},
+		{"https://example.com/", "/"},
+		{"https://example.com/tunnel", "/tunnel"},
+		{"https://example.com/a%2Fb/c?x=1", "/a%2Fb/c"},
+		{"https://example.com/with space", "/with%20space"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatalf("NewRequest(%q): %v", tt.url, err)
+		}
+		if got := signedPath(req.URL); got != tt.want {
+			t.Errorf("signedPath(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ============================================================================
+// Client Certificates (mTLS)
+// ============================================================================
+
+// clientCertificate serves the -client-cert/-client-key pair to TLS
+// handshakes and reloads it when either file's modification time changes,
+// so certificates can be rotated without restarting the proxy.
+type clientCertificate struct {
+	certFile   string
+	keyFile    string
+	passphrase string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newClientCertificate(cfg Config) (*clientCertificate, error) {
+	if cfg.ClientCertFile == "" && cfg.ClientKeyFile == "" {
+		return nil, nil
+	}
+	if cfg.ClientCertFile == "" || cfg.ClientKeyFile == "" {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+
+	c := &clientCertificate{
+		certFile:   cfg.ClientCertFile,
+		keyFile:    cfg.ClientKeyFile,
+		passphrase: cfg.ClientKeyPassphrase,
+	}
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.cert, c.modTime = cert, modTime
+	return c, nil
+}
+
+// get implements tls.Config.GetClientCertificate.
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := c.latestModTime()
+	if err != nil || !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := c.load()
+	if err != nil {
+		// Files may be mid-rotation; keep the old pair and retry next handshake.
+		slog.Warn("Failed to reload client certificate", "error", err)
+		return c.cert, nil
+	}
+	c.cert, c.modTime = cert, modTime
+	slog.Info("Reloaded client certificate", "file", c.certFile, "expires", cert.Leaf.NotAfter.Format(time.DateOnly))
+	return c.cert, nil
+}
+
+func (c *clientCertificate) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *clientCertificate) load() (*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(c.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client key: %w", err)
+	}
+	if keyPEM, err = decryptKeyPEM(keyPEM, c.passphrase); err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load client certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// decryptKeyPEM decrypts an encrypted PKCS#8 key ("ENCRYPTED PRIVATE KEY", as
+// written by `openssl genpkey -aes256` or `openssl pkcs8 -topk8`) or a legacy
+// encrypted PEM key ("Proc-Type: 4,ENCRYPTED"). Unencrypted keys pass through.
+func decryptKeyPEM(keyPEM []byte, passphrase string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("client key: no PEM data found")
+	}
+	encryptedPKCS8 := block.Type == "ENCRYPTED PRIVATE KEY"
+	//lint:ignore SA1019 legacy PEM encryption is still accepted for existing keys
+	if !encryptedPKCS8 && !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, nil
+	}
+	if passphrase == "" {
+		return nil, errors.New("client key is encrypted but no passphrase was given")
+	}
+
+	if encryptedPKCS8 {
+		der, err := decryptPKCS8(block.Bytes, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt client key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+	//lint:ignore SA1019 legacy PEM encryption is still accepted for existing keys
+	der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt client key: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+// ============================================================================
+// Encrypted PKCS#8 (RFC 5958, PBES2 from RFC 8018)
+// ============================================================================
+//
+// Only PBES2 is supported: PBKDF2 (HMAC-SHA1 to SHA-512) or scrypt as key
+// derivation, AES-CBC as cipher. That covers what OpenSSL 1.1 and later
+// write by default; the older PBES1 schemes use DES or RC2 and are refused.
+
+var (
+	oidPBES2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt    = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+
+	// PBKDF2 pseudo-random functions; HMAC-SHA1 when absent.
+	pbkdf2PRFs = map[string]func() hash.Hash{
+		"1.2.840.113549.2.7":  sha1.New,
+		"1.2.840.113549.2.8":  sha256.New224,
+		"1.2.840.113549.2.9":  sha256.New,
+		"1.2.840.113549.2.10": sha512.New384,
+		"1.2.840.113549.2.11": sha512.New,
+	}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// decryptPKCS8 returns the PKCS#8 PrivateKeyInfo inside an
+// EncryptedPrivateKeyInfo.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("parse encrypted PKCS#8: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported PKCS#8 encryption %s; re-encrypt with `openssl pkcs8 -topk8 -v2 aes-256-cbc`", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("parse PBES2 parameters: %w", err)
+	}
+
+	var keyLen int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLen = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#8 cipher %s (only AES-CBC is supported)", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC parameters")
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, passphrase, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted key length")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// A wrong passphrase almost always shows up as bad padding, and
+	// otherwise as a PrivateKeyInfo that does not parse.
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("wrong passphrase")
+	}
+	plain = plain[:len(plain)-pad]
+	if _, err := x509.ParsePKCS8PrivateKey(plain); err != nil {
+		return nil, errors.New("wrong passphrase")
+	}
+	return plain, nil
+}
+
+func deriveKey(kdf pkix.AlgorithmIdentifier, passphrase []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("parse PBKDF2 parameters: %w", err)
+		}
+		prf := sha1.New
+		if len(params.PRF.Algorithm) > 0 {
+			var ok bool
+			if prf, ok = pbkdf2PRFs[params.PRF.Algorithm.String()]; !ok {
+				return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", params.PRF.Algorithm)
+			}
+		}
+		return pbkdf2.Key(prf, string(passphrase), params.Salt, params.IterationCount, keyLen)
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("parse scrypt parameters: %w", err)
+		}
+		return scrypt.Key(passphrase, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLen)
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#8 key derivation %s", kdf.Algorithm)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The encrypted keys in testdata hold client-key.pem, encrypted by OpenSSL 3
+// with passphrase "twopass":
+//
+//	openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256 -iter 2048   (pbkdf2-sha256)
+//	openssl pkcs8 -topk8 -v2 aes-128-cbc -scrypt -scrypt_N 1024             (scrypt)
+//	openssl pkcs8 -topk8 -v2 des3                                           (des3)
+//	openssl pkcs8 -topk8 -v1 PBE-SHA1-3DES                                  (pbes1)
+func TestDecryptKeyPEM(t *testing.T) {
+	plain := readTestKey(t, "client-key.pem")
+	block, _ := pem.Decode(plain)
+
+	tests := []struct {
+		name       string
+		file       string
+		passphrase string
+		wantErr    string
+	}{
+		{name: "pbkdf2 sha256", file: "client-key-pbkdf2-sha256.pem", passphrase: "twopass"},
+		{name: "scrypt", file: "client-key-scrypt.pem", passphrase: "twopass"},
+		{name: "unencrypted", file: "client-key.pem"},
+		{name: "unencrypted ignores passphrase", file: "client-key.pem", passphrase: "twopass"},
+		{name: "pbkdf2 wrong passphrase", file: "client-key-pbkdf2-sha256.pem", passphrase: "wrong", wantErr: "wrong passphrase"},
+		{name: "scrypt wrong passphrase", file: "client-key-scrypt.pem", passphrase: "wrong", wantErr: "wrong passphrase"},
+		{name: "no passphrase", file: "client-key-scrypt.pem", wantErr: "no passphrase was given"},
+		{name: "des3 cipher", file: "client-key-des3.pem", passphrase: "twopass", wantErr: "only AES-CBC is supported"},
+		{name: "pbes1", file: "client-key-pbes1.pem", passphrase: "twopass", wantErr: "re-encrypt with `openssl pkcs8 -topk8 -v2 aes-256-cbc`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decryptKeyPEM(readTestKey(t, tt.file), tt.passphrase)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decryptKeyPEM = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decryptKeyPEM = %v", err)
+			}
+			gotBlock, _ := pem.Decode(got)
+			if gotBlock == nil || gotBlock.Type != "PRIVATE KEY" || !bytes.Equal(gotBlock.Bytes, block.Bytes) {
+				t.Errorf("decryptKeyPEM returned a different key:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestDecryptKeyPEMNoPEM(t *testing.T) {
+	if _, err := decryptKeyPEM([]byte("not a key"), "twopass"); err == nil || !strings.Contains(err.Error(), "no PEM data") {
+		t.Errorf("decryptKeyPEM = %v, want a no PEM data error", err)
+	}
+}
+
+func TestDeriveKeyUnsupported(t *testing.T) {
+	md5PRF, err := asn1.Marshal(pbkdf2Params{
+		Salt:           []byte("salt"),
+		IterationCount: 1,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		kdf     pkix.AlgorithmIdentifier
+		wantErr string
+	}{
+		{
+			name:    "pbkdf2 with hmac-md5",
+			kdf:     pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: md5PRF}},
+			wantErr: "unsupported PBKDF2 PRF 1.2.840.113549.2.5",
+		},
+		{
+			name:    "unknown kdf",
+			kdf:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2},
+			wantErr: "unsupported PKCS#8 key derivation",
+		},
+	}
+	for _, tt := range tests {
+		if _, err := deriveKey(tt.kdf, []byte("twopass"), 32); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: deriveKey = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func readTestKey(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
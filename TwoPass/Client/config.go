@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// ============================================================================
+// Config File
+// ============================================================================
+//
+// A config file is JSON with named profiles whose keys are the long flag
+// names, so anything that can be passed on the command line can live in a
+// profile instead (keeping the token out of `ps`):
+//
+//	{
+//	  "default_profile": "home",
+//	  "defaults": {"listen": "127.0.0.1:8080", "auth": "hmac"},
+//	  "profiles": {
+//	    "home": {"url": "https://tunnel.example.com/proxy", "token-file": "/etc/twopass/token"},
+//	    "work": {"upstream": ["name=cf,url=https://a.example.com/p", "name=deno,url=https://b.example.com/p"], "token": "${WORK_TOKEN}"}
+//	  }
+//	}
+//
+// String values have $VAR and ${VAR} expanded from the environment. Arrays
+// repeat a repeatable flag (upstream, rule) and are joined with commas
+// otherwise.
+
+const (
+	sourceDefault = "default"
+	sourceFlag    = "flag"
+	sourceProfile = "profile"
+	sourceShared  = "defaults"
+	sourceDerived = "derived" // expanded from a shorthand flag or read from a file
+)
+
+type configFile struct {
+	DefaultProfile string                                `json:"default_profile"`
+	Defaults       map[string]json.RawMessage            `json:"defaults"`
+	Profiles       map[string]map[string]json.RawMessage `json:"profiles"`
+}
+
+// secretFlags are redacted by `config check`.
+var secretFlags = []string{"token", "socks-pass", "client-key-pass", "admin-token"}
+
+// applyConfigFile sets every flag from the selected profile, then from the
+// file's defaults, that was not given on the command line. It returns the
+// name of the profile used and records the source of each value it sets.
+func applyConfigFile(fs *flag.FlagSet, path, profile string, sources map[string]string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read config file: %w", err)
+	}
+	var file configFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return "", fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	if profile == "" {
+		profile = file.DefaultProfile
+	}
+	if profile == "" && len(file.Profiles) == 1 {
+		for name := range file.Profiles {
+			profile = name
+		}
+	}
+	values, ok := file.Profiles[profile]
+	if profile != "" && !ok {
+		names := make([]string, 0, len(file.Profiles))
+		for name := range file.Profiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return "", fmt.Errorf("config file %s has no profile %q (profiles: %s)", path, profile, strings.Join(names, ", "))
+	}
+	if profile == "" && len(file.Profiles) > 1 {
+		return "", fmt.Errorf("config file %s has several profiles; select one with -profile or default_profile", path)
+	}
+
+	if err := applyConfigValues(fs, values, sourceProfile, sources); err != nil {
+		return "", fmt.Errorf("profile %q: %w", profile, err)
+	}
+	if err := applyConfigValues(fs, file.Defaults, sourceShared, sources); err != nil {
+		return "", fmt.Errorf("defaults: %w", err)
+	}
+	return profile, nil
+}
+
+func applyConfigValues(fs *flag.FlagSet, values map[string]json.RawMessage, source string, sources map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		f := fs.Lookup(key)
+		if f == nil || key == "config" || key == "profile" || key == "v" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if _, set := sources[key]; set {
+			continue
+		}
+		settings, err := configValues(values[key])
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		switch f.Value.(type) {
+		case *upstreamList, *ruleList:
+		default:
+			settings = []string{strings.Join(settings, ",")}
+		}
+		for _, value := range settings {
+			if err := fs.Set(key, value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		sources[key] = source
+	}
+	return nil
+}
+
+// configValues converts a JSON string, number, boolean or array of those to
+// flag values.
+func configValues(raw json.RawMessage) ([]string, error) {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	items, isArray := value.([]any)
+	if !isArray {
+		items = []any{value}
+	}
+
+	values := make([]string, len(items))
+	for i, item := range items {
+		switch v := item.(type) {
+		case string:
+			values[i] = expandEnv(v)
+		case float64, bool:
+			values[i] = fmt.Sprint(v)
+		default:
+			return nil, errors.New("value must be a string, number, boolean or array of those")
+		}
+	}
+	return values, nil
+}
+
+// expandEnv replaces ${VAR} with the environment variable VAR and $$ with a
+// single $. Any other $ is kept as is, so tokens, password hashes and regexes
+// containing $ need no escaping.
+func expandEnv(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+			continue
+		case '{':
+			if end := strings.IndexByte(s[i+2:], '}'); end > 0 {
+				b.WriteString(os.Getenv(s[i+2 : i+2+end]))
+				s = s[i+3+end:]
+				continue
+			}
+		}
+		b.WriteByte('$')
+		s = s[i+1:]
+	}
+}
+
+// readTokenFile returns the first line of a token file.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read token file: %w", err)
+	}
+	token, _, _ := strings.Cut(string(data), "\n")
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// ============================================================================
+// Config Check and Reload
+// ============================================================================
+
+// runConfigCheck implements `twopass config check [flags]`: it validates the
+// merged configuration and prints every effective value with its source.
+func runConfigCheck(args []string) {
+	pc, err := parseConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	if pc.configFile != "" {
+		fmt.Printf("# config file %s, profile %q\n", pc.configFile, pc.profile)
+	}
+	pc.flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "profile" || f.Name == "v" || f.Name == "upstream" || f.Name == "rule" {
+			return
+		}
+		value := f.Value.String()
+		if value != "" && slices.Contains(secretFlags, f.Name) {
+			value = "<redacted>"
+		}
+		source, ok := pc.sources[f.Name]
+		switch {
+		case ok:
+		case f.Value.String() != f.DefValue:
+			source = sourceDerived
+		default:
+			source = sourceDefault
+		}
+		fmt.Printf("%-18s %-40q # %s\n", f.Name, value, source)
+	})
+
+	fmt.Println("# effective upstreams")
+	for _, up := range pc.config.upstreamConfigs() {
+		fmt.Printf("upstream name=%s,url-post=%s,url-get=%s,auth=%s,token=<redacted>", up.Name, up.URLPOST, up.URLGET, up.AuthScheme)
+		for _, field := range []struct{ key, value string }{
+			{"addr", up.Addr},
+			{"http-post", up.HTTPVersionPOST},
+			{"http-get", up.HTTPVersionGET},
+			{"sni-post", up.SNIPOST},
+			{"sni-get", up.SNIGET},
+			{"host-post", up.HostPOST},
+			{"host-get", up.HostGET},
+		} {
+			if field.value != "" {
+				fmt.Printf(",%s=%s", field.key, field.value)
+			}
+		}
+		fmt.Println()
+	}
+	if len(pc.config.Rules) > 0 {
+		fmt.Println("# routing rules, first match wins")
+		for _, r := range pc.config.Rules {
+			fmt.Printf("rule %s\n", r.spec)
+		}
+	}
+	fmt.Println("# configuration OK")
+}
+
+// reloadOnSIGHUP re-reads the command line and config file on every SIGHUP.
+// An invalid configuration is logged and the running one kept.
+func (p *Proxy) reloadOnSIGHUP(args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		slog.Info("SIGHUP received, reloading configuration")
+		pc, err := parseConfig(args)
+		if err != nil {
+			slog.Error("Reload failed, keeping current configuration", "error", err)
+			continue
+		}
+		if err := p.Reload(pc.config); err != nil {
+			slog.Error("Reload failed, keeping current configuration", "error", err)
+		}
+	}
+}
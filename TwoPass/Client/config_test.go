@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestConfigValues(t *testing.T) {
+	t.Setenv("TWOPASS_TEST_TOKEN", "s3cret")
+
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{raw: `"${TWOPASS_TEST_TOKEN}"`, want: []string{"s3cret"}},
+		{raw: `"a${TWOPASS_TEST_TOKEN}b"`, want: []string{"as3cretb"}},
+		{raw: `"${TWOPASS_TEST_UNSET}"`, want: []string{""}},
+		{raw: `"pa$word$"`, want: []string{"pa$word$"}},
+		{raw: `"$TWOPASS_TEST_TOKEN"`, want: []string{"$TWOPASS_TEST_TOKEN"}},
+		{raw: `"$${TWOPASS_TEST_TOKEN}"`, want: []string{"${TWOPASS_TEST_TOKEN}"}},
+		{raw: `"^api\\d+$"`, want: []string{`^api\d+$`}},
+		{raw: `"${unterminated"`, want: []string{"${unterminated"}},
+		{raw: `["a", 8080, true]`, want: []string{"a", "8080", "true"}},
+		{raw: `{"a": 1}`, wantErr: true},
+		{raw: `[null]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := configValues(json.RawMessage(tt.raw))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("configValues(%s) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("configValues(%s) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -4,12 +4,12 @@ go 1.25.3
 
 require (
 	github.com/quic-go/quic-go v0.55.0
+	golang.org/x/crypto v0.45.0
 	golang.org/x/net v0.47.0
 )
 
 require (
 	github.com/quic-go/qpack v0.5.1 // indirect
-	golang.org/x/crypto v0.45.0 // indirect
 	golang.org/x/mod v0.29.0 // indirect
 	golang.org/x/sync v0.18.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// ============================================================================
+// Logging
+// ============================================================================
+//
+// Everything is logged through log/slog. Startup and configuration messages
+// are Info, the life cycle of individual connections is Debug, and failures
+// are Warn or Error. Stream errors that only mean the other side went away
+// (see isExpectedError) drop to Debug. Tunnel code logs through the logger
+// stored in its context, which carries the session, target, protocol and
+// upstream of the tunnel.
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logLevel is shared by every handler so a reload can change it.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel accepts debug, info, warn and error.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level: %s", s)
+	}
+	return level, nil
+}
+
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case logFormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case logFormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+}
+
+// setupLogging installs the default logger. Output of the standard log
+// package, including that of dependencies, is routed through it at Info.
+func setupLogging(level, format string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	handler, err := newLogHandler(os.Stderr, format)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(lvl)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs at Error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// errorLevel maps a stream error to the level it is logged at.
+func errorLevel(err error) slog.Level {
+	if isExpectedError(err) {
+		return slog.LevelDebug
+	}
+	return slog.LevelWarn
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the tunnel logger stored in ctx, or the default logger.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -1,4 +1,4 @@
-// TCP tunnel client over HTTP/2 stream
+// TCP tunnel client (and reference server) over HTTP/2 stream
 package main
 
 import (
@@ -8,13 +8,18 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -29,17 +34,10 @@ import (
 var Version = "dev"
 
 const (
-	protocolV1       = "v1"
-	protocolV2       = "v2"
-	logPrefixInfo    = "[*]"
-	logPrefixSuccess = "[+]"
-	logPrefixRequest = "[>]"
-	logPrefixTunnel  = "[<]"
-	logPrefixStream  = "[=]"
-	logPrefixClose   = "[-]"
-	logPrefixError   = "[!]"
-	bufferSize       = 128 * 1024
-	idleConnTimeout  = 120 * time.Second
+	protocolV1      = "v1"
+	protocolV2      = "v2"
+	bufferSize      = 128 * 1024
+	idleConnTimeout = 120 * time.Second
 )
 
 // ============================================================================
@@ -48,40 +46,112 @@ const (
 
 type Config struct {
 	// Server Configuration
-	ListenAddr string
-	Version    int
+	ListenAddr      string
+	SOCKSListenAddr string
+	SOCKSUsername   string
+	SOCKSPassword   string
+	MixedMode       bool
+	TransparentAddr string
+	Sniff           bool
+	MetricsAddr     string
+	AdminAddr       string
+	AdminToken      string
+	Version         int
+
+	// Client Access
+	ProxyUsersFile string
+	ProxyUsers     *proxyUsers
+	AllowedClients []netip.Prefix
+
+	// Logging
+	LogLevel         string
+	LogFormat        string
+	AccessLog        string
+	AccessLogMaxSize int
+	AccessLogBackups int
 
 	// Upstream Server Configuration
 	UpstreamURLPOST string
 	UpstreamURLGET  string
 	UpstreamAddr    string
 	AuthToken       string
+	AuthScheme      string
+	Upstreams       []UpstreamConfig
+	UpstreamPolicy  string
+	HealthInterval  time.Duration
+	HealthTimeout   time.Duration
+
+	// Protocol Negotiation
+	FallbackCooldown time.Duration
+
+	// Routing
+	Rules        []rule
+	DefaultRoute route
 
 	// HTTP Protocol Configuration
 	HTTPVersionPOST string
 	HTTPVersionGET  string
 
+	// Domain Fronting (TLS SNI and Host header overrides)
+	SNIPOST  string
+	SNIGET   string
+	HostPOST string
+	HostGET  string
+
+	// Multiplexing and Transfer Modes
+	Mux          bool
+	UploadMode   string
+	PacketSize   int
+	DownloadMode string
+
 	// Connection Settings
 	InsecureSkipVerify bool
+	CAFile             string
+	Pins               []string
+	TOFUFile           string
 	ConnTimeout        time.Duration
 	StreamTimeout      time.Duration
+	DrainTimeout       time.Duration
+
+	// Client Certificate (mTLS)
+	ClientCertFile      string
+	ClientKeyFile       string
+	ClientKeyPassphrase string
 }
 
 type Proxy struct {
-	config         Config
-	httpClientPOST *http.Client
-	httpClientGET  *http.Client
+	config     Config
+	verifier   *certVerifier
+	clientCert *clientCertificate
+	upstreams  *upstreamPool
+	metrics    *metrics
+
+	// forwardTransports hold the keep-alive tunnels of forwarded requests,
+	// keyed by the upstream of the proxy user ("" for none).
+	forwardMu         sync.Mutex
+	forwardTransports map[string]*http.Transport
+
+	// active is shared by every generation of the proxy and points to the
+	// newest one. Listeners hand each accepted connection to it, so a reload
+	// applies to new tunnels while existing ones finish on the old config.
+	active *atomic.Pointer[Proxy]
+
+	// tunnels, metrics and the access log are shared by all generations;
+	// listeners belong to the first.
+	tunnels     *tunnelTracker
+	accessLog   *accessLog
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+	servers     []*http.Server
 }
 
 // ============================================================================
 // HTTP Transport Factory Functions
 // ============================================================================
 
-func createH3Transport(cfg Config, overrideAddr, port string) *http3.Transport {
+func createH3Transport(cfg Config, overrideAddr, port string, tlsConfig *tls.Config) *http3.Transport {
 	transport := &http3.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: cfg.InsecureSkipVerify,
-		},
+		TLSClientConfig: tlsConfig,
 	}
 	if overrideAddr != "" {
 		transport.Dial = func(ctx context.Context, addr string, tlsCfg *tls.Config, quicCfg *quic.Config) (*quic.Conn, error) {
@@ -95,7 +165,8 @@ func createH3Transport(cfg Config, overrideAddr, port string) *http3.Transport {
 	return transport
 }
 
-func createH2Transport(cfg Config, overrideAddr, port string, dialer *net.Dialer) *http.Transport {
+func createH2Transport(cfg Config, overrideAddr, port string, tlsConfig *tls.Config, dialer *net.Dialer) *http.Transport {
+	tlsConfig.NextProtos = []string{"h2"}
 	return &http.Transport{
 		ForceAttemptHTTP2: true,
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -104,10 +175,7 @@ func createH2Transport(cfg Config, overrideAddr, port string, dialer *net.Dialer
 			}
 			return dialer.DialContext(ctx, network, addr)
 		},
-		TLSClientConfig: &tls.Config{
-			NextProtos:         []string{"h2"},
-			InsecureSkipVerify: cfg.InsecureSkipVerify,
-		},
+		TLSClientConfig:     tlsConfig,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
 		MaxConnsPerHost:     10,
@@ -130,33 +198,83 @@ func createH2CTransport(cfg Config, overrideAddr, hostname, port string, dialer
 	}
 }
 
-func createTransport(cfg Config, parsedURL *url.URL, httpVersion string, isGET bool) http.RoundTripper {
+// createH1Transport speaks HTTP/1.1 only, over TLS or cleartext depending on
+// the URL scheme. Bodies are sent with chunked encoding.
+func createH1Transport(cfg Config, overrideAddr, port string, tlsConfig *tls.Config, dialer *net.Dialer) *http.Transport {
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	return &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if overrideAddr != "" {
+				addr = net.JoinHostPort(overrideAddr, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:     tlsConfig,
+		DisableCompression:  true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+}
+
+func createTransport(cfg Config, verifier *certVerifier, clientCert *clientCertificate, up UpstreamConfig, parsedURL *url.URL, httpVersion string, isGET bool) (http.RoundTripper, error) {
 	port := extractPort(parsedURL)
 	dialer := &net.Dialer{Timeout: cfg.ConnTimeout}
 
-	if httpVersion == "" || httpVersion == "auto" {
-		httpVersion = autoDetectHTTPVersion(parsedURL.Scheme, isGET)
-	}
-
-	direction := "POST"
+	direction, sni, host := "POST", up.SNIPOST, up.HostPOST
 	if isGET {
-		direction = "GET"
+		direction, sni, host = "GET", up.SNIGET, up.HostGET
+	}
+	serverName := sni
+	if serverName == "" {
+		serverName = parsedURL.Hostname()
+	}
+	tlsConfig := verifier.tlsConfig(sni, serverName, net.JoinHostPort(serverName, port))
+	if clientCert != nil {
+		tlsConfig.GetClientCertificate = clientCert.get
 	}
 
+	var transport http.RoundTripper
 	switch httpVersion {
 	case "h3":
-		log.Printf("%s Configuring %s client for H3 (HTTP/3 over QUIC)", logPrefixInfo, direction)
-		return createH3Transport(cfg, cfg.UpstreamAddr, port)
+		slog.Info("Configuring client for H3 (HTTP/3 over QUIC)", "upstream", up.Name, "direction", direction)
+		transport = createH3Transport(cfg, up.Addr, port, tlsConfig)
 	case "h2":
-		log.Printf("%s Configuring %s client for H2 (HTTP/2 over TLS)", logPrefixInfo, direction)
-		return createH2Transport(cfg, cfg.UpstreamAddr, port, dialer)
+		slog.Info("Configuring client for H2 (HTTP/2 over TLS)", "upstream", up.Name, "direction", direction)
+		transport = createH2Transport(cfg, up.Addr, port, tlsConfig, dialer)
 	case "h2c":
-		log.Printf("%s Configuring %s client for H2C (HTTP/2 over cleartext)", logPrefixInfo, direction)
-		return createH2CTransport(cfg, cfg.UpstreamAddr, parsedURL.Hostname(), port, dialer)
+		slog.Info("Configuring client for H2C (HTTP/2 over cleartext)", "upstream", up.Name, "direction", direction)
+		if sni != "" {
+			slog.Warn("SNI override has no effect on cleartext H2C", "upstream", up.Name)
+		}
+		transport = createH2CTransport(cfg, up.Addr, parsedURL.Hostname(), port, dialer)
+	case "h1":
+		slog.Info("Configuring client for H1 (HTTP/1.1)", "upstream", up.Name, "direction", direction)
+		transport = createH1Transport(cfg, up.Addr, port, tlsConfig, dialer)
 	default:
-		log.Fatalf("%s Unknown HTTP version: %s", logPrefixError, httpVersion)
-		return nil
+		return nil, fmt.Errorf("upstream %s: unknown HTTP version %q", up.Name, httpVersion)
+	}
+
+	if host != "" {
+		transport = hostOverride{transport, host}
 	}
+	return transport, nil
+}
+
+// hostOverride sends every request with a fixed Host header (HTTP/2 and
+// HTTP/3 :authority), independent of the URL used to pick the connection.
+type hostOverride struct {
+	http.RoundTripper
+	host string
+}
+
+func (h hostOverride) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Host = h.host
+	return h.RoundTripper.RoundTrip(req)
 }
 
 // ============================================================================
@@ -164,46 +282,234 @@ func createTransport(cfg Config, parsedURL *url.URL, httpVersion string, isGET b
 // ============================================================================
 
 func NewProxy(cfg Config) (*Proxy, error) {
-	parsedPOST, err := url.Parse(cfg.UpstreamURLPOST)
+	tunnels := newTunnelTracker()
+	p, err := newProxy(cfg, newMetrics(tunnels.count))
+	if err != nil {
+		return nil, err
+	}
+	p.active = new(atomic.Pointer[Proxy])
+	p.active.Store(p)
+	p.tunnels = tunnels
+	if cfg.AccessLog != "" {
+		if p.accessLog, err = newAccessLog(cfg.AccessLog, int64(cfg.AccessLogMaxSize)<<20, cfg.AccessLogBackups); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func newProxy(cfg Config, m *metrics) (*Proxy, error) {
+	p := &Proxy{config: cfg, metrics: m}
+	verifier, err := newCertVerifier(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("invalid POST URL: %w", err)
+		return nil, err
+	}
+	p.verifier = verifier
+	if p.clientCert, err = newClientCertificate(cfg); err != nil {
+		return nil, err
 	}
-	parsedGET, err := url.Parse(cfg.UpstreamURLGET)
+	upstreams, err := newUpstreamPool(p)
 	if err != nil {
-		return nil, fmt.Errorf("invalid GET URL: %w", err)
+		return nil, err
+	}
+	p.upstreams = upstreams
+	p.forwardTransports = make(map[string]*http.Transport)
+	return p, nil
+}
+
+// forwardTransport returns the transport for forwarded requests of users
+// mapped to upstream, creating it on first use.
+func (p *Proxy) forwardTransport(upstream string) *http.Transport {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+	if transport, ok := p.forwardTransports[upstream]; ok {
+		return transport
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return p.dialTunnel(ctx, addr, upstream)
+		},
+		DisableCompression:  true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     idleConnTimeout,
 	}
+	p.forwardTransports[upstream] = transport
+	return transport
+}
 
-	transportPOST := createTransport(cfg, parsedPOST, cfg.HTTPVersionPOST, false)
-	var transportGET http.RoundTripper
-	if cfg.Version == 2 {
-		transportGET = createTransport(cfg, parsedGET, cfg.HTTPVersionGET, true)
+func (p *Proxy) closeIdleForwardConnections() {
+	p.forwardMu.Lock()
+	defer p.forwardMu.Unlock()
+	for _, transport := range p.forwardTransports {
+		transport.CloseIdleConnections()
 	}
+}
 
-	return &Proxy{
-		config:         cfg,
-		httpClientPOST: &http.Client{Transport: transportPOST, Timeout: 0},
-		httpClientGET:  &http.Client{Transport: transportGET, Timeout: 0},
-	}, nil
+// current returns the newest proxy generation.
+func (p *Proxy) current() *Proxy {
+	return p.active.Load()
+}
+
+// Reload builds a new proxy generation from cfg and makes it current. Tunnels
+// already running keep their upstreams; listener addresses need a restart.
+func (p *Proxy) Reload(cfg Config) error {
+	old := p.current()
+	if cfg.ListenAddr != old.config.ListenAddr || cfg.SOCKSListenAddr != old.config.SOCKSListenAddr || cfg.MixedMode != old.config.MixedMode || cfg.MetricsAddr != old.config.MetricsAddr ||
+		cfg.AdminAddr != old.config.AdminAddr || cfg.TransparentAddr != old.config.TransparentAddr {
+		slog.Warn("Listener changes (-listen, -socks, -mixed, -transparent, -metrics, -admin) require a restart and are ignored")
+		cfg.ListenAddr, cfg.SOCKSListenAddr, cfg.MixedMode = old.config.ListenAddr, old.config.SOCKSListenAddr, old.config.MixedMode
+		cfg.TransparentAddr = old.config.TransparentAddr
+		cfg.MetricsAddr, cfg.AdminAddr = old.config.MetricsAddr, old.config.AdminAddr
+	}
+	if cfg.AccessLog != old.config.AccessLog || cfg.AccessLogMaxSize != old.config.AccessLogMaxSize || cfg.AccessLogBackups != old.config.AccessLogBackups {
+		slog.Warn("Access log changes (-access-log, -access-log-max-size, -access-log-backups) require a restart and are ignored")
+		cfg.AccessLog, cfg.AccessLogMaxSize, cfg.AccessLogBackups = old.config.AccessLog, old.config.AccessLogMaxSize, old.config.AccessLogBackups
+	}
+	if cfg.LogFormat != old.config.LogFormat {
+		slog.Warn("Log format changes (-log-format) require a restart and are ignored")
+		cfg.LogFormat = old.config.LogFormat
+	}
+
+	next, err := newProxy(cfg, old.metrics)
+	if err != nil {
+		return err
+	}
+	next.active = p.active
+	next.tunnels = p.tunnels
+	next.accessLog = p.accessLog
+	next.startUpstreams()
+	if pinned := old.upstreams.pinnedName(); pinned != "" {
+		if err := next.upstreams.pin(pinned); err != nil {
+			slog.Warn("Pinned upstream no longer exists, returning to the selection policy", "upstream", pinned, "policy", cfg.UpstreamPolicy)
+		}
+	}
+	p.active.Store(next)
+	if cfg.LogLevel != old.config.LogLevel {
+		level, _ := parseLogLevel(cfg.LogLevel)
+		logLevel.Set(level)
+		slog.Info("Log level changed", "level", cfg.LogLevel)
+	}
+
+	old.upstreams.close()
+	old.closeIdleForwardConnections()
+	slog.Info("Configuration reloaded; new tunnels use the new settings")
+	return nil
 }
 
 func (p *Proxy) Start() error {
-	log.Printf("%s Listening for connections on: %s", logPrefixInfo, p.config.ListenAddr)
-	if p.config.Version == 1 {
-		log.Printf("%s Tunnel URL: %s", logPrefixInfo, p.config.UpstreamURLPOST)
-	} else {
-		log.Printf("%s POST (upload) to: %s", logPrefixInfo, p.config.UpstreamURLPOST)
-		log.Printf("%s GET (download) from: %s", logPrefixInfo, p.config.UpstreamURLGET)
+	slog.Info("Listening for connections", "addr", p.config.ListenAddr)
+	if p.config.ProxyUsers != nil {
+		slog.Info("Proxy authentication is required", "users", len(p.config.ProxyUsers.users))
 	}
-	log.Printf("%s Using protocol version: v%d", logPrefixInfo, p.config.Version)
-	if p.config.UpstreamAddr != "" {
-		log.Printf("%s Upstream address override is active: %s", logPrefixInfo, p.config.UpstreamAddr)
+	if len(p.config.AllowedClients) > 0 {
+		slog.Info("Client address allowlist is active", "prefixes", len(p.config.AllowedClients))
 	}
+	if p.config.Sniff {
+		slog.Info("Sniffing TLS SNI and HTTP Host to replace IP targets")
+	}
+	if host, _, _ := net.SplitHostPort(p.config.ListenAddr); !isLoopbackHost(host) && p.config.ProxyUsers == nil && len(p.config.AllowedClients) == 0 {
+		slog.Warn("Proxy is reachable beyond localhost without -proxy-users or -allow", "addr", p.config.ListenAddr)
+	}
+	p.startUpstreams()
 
-	server := &http.Server{
-		Addr:    p.config.ListenAddr,
-		Handler: http.HandlerFunc(p.dispatchRequest),
+	errCh := make(chan error, 5)
+	if p.config.SOCKSListenAddr != "" {
+		go func() {
+			errCh <- p.startSOCKS5()
+		}()
+	}
+	if p.config.TransparentAddr != "" {
+		go func() {
+			errCh <- p.startTransparent()
+		}()
+	}
+	if p.config.MetricsAddr != "" {
+		go func() {
+			errCh <- p.startMetrics(p.config.MetricsAddr)
+		}()
+	}
+	if p.config.AdminAddr != "" {
+		go func() {
+			errCh <- p.startAdmin(p.config.AdminAddr)
+		}()
+	}
+
+	go func() {
+		server := &http.Server{
+			Addr: p.config.ListenAddr,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p.current().dispatchRequest(w, r)
+			}),
+		}
+		p.addServer(server)
+		if p.config.MixedMode {
+			errCh <- p.startMixed(server)
+			return
+		}
+		errCh <- server.ListenAndServe()
+	}()
+	return <-errCh
+}
+
+// startUpstreams logs the effective settings and starts health probing.
+func (p *Proxy) startUpstreams() {
+	for _, up := range p.upstreams.upstreams {
+		if p.config.Version == 1 {
+			slog.Info("Tunnel URL", "upstream", up.config.Name, "url", up.config.URLPOST)
+		} else {
+			slog.Info("POST (upload) URL", "upstream", up.config.Name, "url", up.config.URLPOST)
+			slog.Info("GET (download) URL", "upstream", up.config.Name, "url", up.config.URLGET)
+		}
+		if up.config.Addr != "" {
+			slog.Info("Upstream address override is active", "upstream", up.config.Name, "addr", up.config.Addr)
+		}
+		if up.config.SNIPOST != "" || up.config.SNIGET != "" {
+			slog.Info("SNI override is active", "upstream", up.config.Name, "post", up.config.SNIPOST, "get", up.config.SNIGET)
+		}
+		if up.config.HostPOST != "" || up.config.HostGET != "" {
+			slog.Info("Host override is active", "upstream", up.config.Name, "post", up.config.HostPOST, "get", up.config.HostGET)
+		}
+		if up.config.AuthScheme == authHMAC {
+			slog.Info("Using HMAC-signed authentication", "upstream", up.config.Name)
+		}
+	}
+	if p.config.Version == 0 {
+		slog.Info("Using protocol version: auto (negotiated per upstream)")
+	} else {
+		slog.Info("Using protocol version", "version", p.config.Version)
+	}
+	if p.config.CAFile != "" {
+		slog.Info("Verifying upstream certificates against CA bundle", "file", p.config.CAFile)
+	}
+	if len(p.config.Pins) > 0 {
+		slog.Info("Certificate pinning is enabled", "pins", len(p.config.Pins))
+	}
+	if p.config.TOFUFile != "" {
+		slog.Info("Trust-on-first-use store", "file", p.config.TOFUFile)
+	}
+	if p.clientCert != nil {
+		slog.Info("Presenting client certificate (reloaded on change)", "file", p.config.ClientCertFile)
+	}
+	if p.config.Mux {
+		slog.Info("Stream multiplexing is enabled")
+	}
+	if p.config.UploadMode == uploadModePacket {
+		slog.Info("V2 packet upload mode is enabled", "packet_size", p.config.PacketSize)
+	}
+	if p.config.DownloadMode == downloadModePoll {
+		slog.Info("V2 long-poll download mode is enabled")
+	}
+	if len(p.upstreams.upstreams) > 1 {
+		slog.Info("Upstream selection policy", "policy", p.config.UpstreamPolicy)
+	}
+	if len(p.upstreams.upstreams) > 1 && p.config.HealthInterval > 0 {
+		go p.upstreams.checkHealth(p.config.HealthInterval, p.config.HealthTimeout)
+	} else {
+		for _, up := range p.upstreams.upstreams {
+			go up.negotiate(p.config.HealthTimeout)
+		}
 	}
-	return server.ListenAndServe()
 }
 
 // ============================================================================
@@ -211,22 +517,66 @@ func (p *Proxy) Start() error {
 // ============================================================================
 
 func (p *Proxy) dispatchRequest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s Accepted connection from %s", logPrefixSuccess, r.RemoteAddr)
+	slog.Debug("Accepted connection", "client", r.RemoteAddr)
+
+	if !p.clientAllowed(r.RemoteAddr) {
+		slog.Warn("Client address not allowed", "client", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodGet && !r.URL.IsAbs() && r.URL.Path == pacPath {
+		p.servePAC(w, r)
+		return
+	}
+	user, ok := p.authorizeProxy(w, r)
+	if !ok {
+		return
+	}
 
 	if r.Method != http.MethodConnect {
-		log.Printf("%s Method not allowed: %s", logPrefixError, r.Method)
+		if r.URL.IsAbs() {
+			p.handleForward(w, r, user.upstream)
+			return
+		}
+		slog.Warn("Method not allowed", "client", r.RemoteAddr, "method", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	switch p.config.Version {
-	case 1:
-		p.handleConnectV1(w, r)
-	case 2:
-		p.handleConnectV2(w, r)
+	rt := p.routeFor(r.Host)
+	switch rt.action {
+	case routeBlock:
+		slog.Info("Request blocked by rule", "client", r.RemoteAddr, "target", r.Host)
+		http.Error(w, "Blocked by proxy rule", http.StatusForbidden)
+		return
+	case routeDirect:
+		p.handleConnectDirect(w, r)
+		return
+	}
+
+	if rt.upstream == "" {
+		rt.upstream = user.upstream
+	}
+	up := p.upstreamFor(rt)
+	switch {
+	case up.useMux(p.config.Mux):
+		p.handleConnectMux(w, r, up)
+	case up.protocolVersion(p.config.Version) == 1:
+		p.handleConnectV1(w, r, up)
 	default:
-		log.Printf("%s Invalid protocol version configured: %d", logPrefixError, p.config.Version)
-		http.Error(w, "Invalid internal configuration", http.StatusInternalServerError)
+		p.handleConnectV2(w, r, up)
+	}
+}
+
+// tunnel runs the configured protocol version over an already accepted client connection.
+func (p *Proxy) tunnel(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort string) {
+	switch {
+	case up.useMux(p.config.Mux):
+		p.tunnelMux(ctx, up, clientConn, targetHost, targetPort)
+	case up.protocolVersion(p.config.Version) == 1:
+		p.tunnelV1(ctx, up, clientConn, targetHost, targetPort)
+	default:
+		p.tunnelV2(ctx, up, clientConn, targetHost, targetPort)
 	}
 }
 
@@ -234,80 +584,113 @@ func (p *Proxy) dispatchRequest(w http.ResponseWriter, r *http.Request) {
 // V1 Protocol Handler
 // ============================================================================
 
-func (p *Proxy) handleConnectV1(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s [%s] Proxy request for %s", logPrefixRequest, protocolV1, r.Host)
+func (p *Proxy) handleConnectV1(w http.ResponseWriter, r *http.Request, up *upstream) {
+	slog.Info("Proxy request", "protocol", protocolV1, "client", r.RemoteAddr, "target", r.Host)
 
 	targetHost, targetPort, err := parseAndFormatTarget(r.Host)
 	if err != nil {
-		log.Printf("%s [%s] Invalid target host format: %s", logPrefixError, protocolV1, r.Host)
+		slog.Warn("Invalid target host format", "protocol", protocolV1, "target", r.Host)
 		http.Error(w, "Invalid target host format", http.StatusBadRequest)
 		return
 	}
 
 	clientConn, err := hijackAndRespond(w, p.config.StreamTimeout)
 	if err != nil {
-		log.Printf("%s [%s] Hijack failed: %v", logPrefixError, protocolV1, err)
+		slog.Warn("Hijack failed", "protocol", protocolV1, "error", err)
 		return
 	}
 	defer clientConn.Close()
 
-	ctx := r.Context()
+	p.tunnelV1(r.Context(), up, clientConn, targetHost, targetPort)
+	slog.Debug("Connection closed", "protocol", protocolV1, "target", r.Host)
+}
+
+func (p *Proxy) tunnelV1(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort string) {
+	ctx, clientConn, done := p.openTunnel(ctx, protocolV1, generateSessionID(), up.config.Name, clientConn, targetHost, targetPort)
+	defer done()
+	logger := loggerFrom(ctx)
+	tunnel := tunnelFrom(ctx)
+
 	if p.config.StreamTimeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, p.config.StreamTimeout)
 		defer cancel()
 	}
 
-	postReq, err := http.NewRequestWithContext(ctx, "POST", p.config.UpstreamURLPOST, clientConn)
+	postReq, err := http.NewRequestWithContext(ctx, "POST", up.config.URLPOST, clientConn)
 	if err != nil {
-		log.Printf("%s [%s] Failed to create POST request: %v", logPrefixError, protocolV1, err)
+		logger.Error("Failed to create POST request", "error", err)
+		tunnel.closing(closeStreamError)
 		return
 	}
-	p.setTunnelHeaders(postReq, targetHost, targetPort, "")
+	up.setTunnelHeaders(postReq, targetHost, targetPort, "")
 
-	upstreamResp, err := p.httpClientPOST.Do(postReq)
+	start := time.Now()
+	upstreamResp, err := up.httpClientPOST.Do(postReq)
 	if err != nil {
-		log.Printf("%s [%s] Failed to connect to upstream: %v", logPrefixError, protocolV1, err)
+		logger.Log(ctx, errorLevel(err), "Failed to connect to upstream", "error", err)
+		tunnel.closing(upstreamErrorReason(err))
+		up.reportFailure(err)
+		if !isExpectedError(err) {
+			p.metrics.upstreamFailure(up.config.Name, nil)
+		}
 		return
 	}
 	defer upstreamResp.Body.Close()
+	p.metrics.observeLatency(up.httpVersionPOST, start)
+	tunnel.recordResponse("POST", up.httpVersionPOST, upstreamResp.StatusCode)
 
 	if upstreamResp.StatusCode != http.StatusOK {
-		log.Printf("%s [%s] Upstream returned status: %s", logPrefixError, protocolV1, upstreamResp.Status)
+		logger.Warn("Upstream returned error status", "status", upstreamResp.Status)
+		tunnel.closing(closeUpstreamStatus)
+		up.reportFailure(errUpstreamStatus(upstreamResp))
+		p.metrics.upstreamFailure(up.config.Name, upstreamResp)
 		return
 	}
-	log.Printf("%s [%s] Upstream tunnel established", logPrefixTunnel, protocolV1)
+	up.reportSuccess()
+	up.learnCapabilities(upstreamResp.Header)
+	logger.Debug("Upstream tunnel established")
+	tunnel.established()
 
 	buf := make([]byte, bufferSize)
 	_, err = io.CopyBuffer(clientConn, upstreamResp.Body, buf)
-	if err != nil && !isExpectedError(err) {
-		log.Printf("%s [%s] Stream error: %v", logPrefixError, protocolV1, err)
+	if err != nil {
+		logger.Log(ctx, errorLevel(err), "Stream error", "error", err)
 	}
-
-	log.Printf("%s [%s] Connection closed for %s", logPrefixClose, protocolV1, r.Host)
+	tunnel.closing(closeReasonFor(err))
 }
 
 // ============================================================================
 // V2 Protocol Handlers
 // ============================================================================
 
-func (p *Proxy) handleConnectV2(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s [%s] Proxy request for %s", logPrefixRequest, protocolV2, r.Host)
+func (p *Proxy) handleConnectV2(w http.ResponseWriter, r *http.Request, up *upstream) {
+	slog.Info("Proxy request", "protocol", protocolV2, "client", r.RemoteAddr, "target", r.Host)
 
 	targetHost, targetPort, err := parseAndFormatTarget(r.Host)
 	if err != nil {
-		log.Printf("%s [%s] Invalid CONNECT host: %s", logPrefixError, protocolV2, r.Host)
+		slog.Warn("Invalid target host format", "protocol", protocolV2, "target", r.Host)
 		http.Error(w, "Invalid target host format", http.StatusBadRequest)
 		return
 	}
 
 	clientConn, err := hijackAndRespond(w, p.config.StreamTimeout)
 	if err != nil {
-		log.Printf("%s [%s] Hijack failed: %v", logPrefixError, protocolV2, err)
+		slog.Warn("Hijack failed", "protocol", protocolV2, "error", err)
 		return
 	}
 
-	ctx, cancel := context.WithCancel(r.Context())
+	p.tunnelV2(r.Context(), up, clientConn, targetHost, targetPort)
+	slog.Debug("Connection closed", "protocol", protocolV2, "target", r.Host)
+}
+
+func (p *Proxy) tunnelV2(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort string) {
+	sessionID := generateSessionID()
+	ctx, clientConn, done := p.openTunnel(ctx, protocolV2, sessionID, up.config.Name, clientConn, targetHost, targetPort)
+	defer done()
+	tunnelFrom(ctx).useHTTP(up.httpVersionPOST, up.httpVersionGET)
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	if p.config.StreamTimeout > 0 {
@@ -315,9 +698,6 @@ func (p *Proxy) handleConnectV2(w http.ResponseWriter, r *http.Request) {
 		defer cancel()
 	}
 
-	sessionID := generateSessionID()
-	log.Printf("%s [%s] Generated Session ID: %s", logPrefixInfo, protocolV2, sessionID)
-
 	var wg sync.WaitGroup
 	var closeOnce sync.Once
 	var connMutex sync.Mutex
@@ -333,84 +713,277 @@ func (p *Proxy) handleConnectV2(w http.ResponseWriter, r *http.Request) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		p.handleV2Upload(ctx, clientConn, targetHost, targetPort, sessionID, protocolV2, &closeOnce, tunnelClose)
+		if up.usePacketUpload(p.config.UploadMode) {
+			p.handleV2PacketUpload(ctx, up, clientConn, targetHost, targetPort, sessionID, protocolV2, &closeOnce, tunnelClose)
+			return
+		}
+		p.handleV2Upload(ctx, up, clientConn, targetHost, targetPort, sessionID, protocolV2, &closeOnce, tunnelClose)
 	}()
 
 	// GET goroutine
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		p.handleV2Download(ctx, clientConn, targetHost, targetPort, sessionID, protocolV2, &connMutex, &closeOnce, tunnelClose)
+		if up.usePollDownload(p.config.DownloadMode) {
+			p.handleV2PollDownload(ctx, up, clientConn, targetHost, targetPort, sessionID, protocolV2, &connMutex, &closeOnce, tunnelClose)
+			return
+		}
+		p.handleV2Download(ctx, up, clientConn, targetHost, targetPort, sessionID, protocolV2, &connMutex, &closeOnce, tunnelClose)
 	}()
 
 	wg.Wait()
-	log.Printf("%s [%s] Connection closed for %s", logPrefixClose, protocolV2, r.Host)
 }
 
-func (p *Proxy) handleV2Upload(ctx context.Context, clientConn net.Conn, targetHost, targetPort, sessionID, protocolV2 string, closeOnce *sync.Once, tunnelClose func()) {
-	postReq, err := http.NewRequestWithContext(ctx, "POST", p.config.UpstreamURLPOST, clientConn)
+func (p *Proxy) handleV2Upload(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort, sessionID, protocolV2 string, closeOnce *sync.Once, tunnelClose func()) {
+	logger := loggerFrom(ctx)
+	tunnel := tunnelFrom(ctx)
+	postReq, err := http.NewRequestWithContext(ctx, "POST", up.config.URLPOST, clientConn)
 	if err != nil {
-		log.Printf("%s [%s] Failed to create POST request: %v", logPrefixError, protocolV2, err)
+		logger.Error("Failed to create POST request", "error", err)
+		tunnel.closing(closeStreamError)
 		closeOnce.Do(tunnelClose)
 		return
 	}
-	p.setTunnelHeaders(postReq, targetHost, targetPort, sessionID)
+	up.setTunnelHeaders(postReq, targetHost, targetPort, sessionID)
 
-	postResp, err := p.httpClientPOST.Do(postReq)
+	postResp, err := up.httpClientPOST.Do(postReq)
 	if err != nil {
+		logger.Log(ctx, errorLevel(err), "POST request failed", "error", err)
+		tunnel.closing(upstreamErrorReason(err))
 		if !isExpectedError(err) {
-			log.Printf("%s [%s] POST request failed: %v", logPrefixError, protocolV2, err)
+			p.metrics.upstreamFailure(up.config.Name, nil)
 		}
+		up.reportFailure(err)
 		closeOnce.Do(tunnelClose)
 		return
 	}
 	defer postResp.Body.Close()
+	tunnel.recordResponse("POST", up.httpVersionPOST, postResp.StatusCode)
 
 	if postResp.StatusCode != http.StatusCreated {
-		log.Printf("%s [%s] Upstream POST failed with status: %s", logPrefixError, protocolV2, postResp.Status)
+		logger.Warn("Upstream POST failed", "status", postResp.Status)
+		tunnel.closing(closeUpstreamStatus)
+		up.reportFailure(errUpstreamStatus(postResp))
+		p.metrics.upstreamFailure(up.config.Name, postResp)
 		closeOnce.Do(tunnelClose)
 		return
 	}
-	log.Printf("%s [%s] Upstream POST tunnel established", logPrefixTunnel, protocolV2)
+	logger.Debug("Upstream POST finished")
+	tunnel.closing(closeCompleted)
 	closeOnce.Do(tunnelClose)
 }
 
-func (p *Proxy) handleV2Download(ctx context.Context, clientConn net.Conn, targetHost, targetPort, sessionID, protocolV2 string, connMutex *sync.Mutex, closeOnce *sync.Once, tunnelClose func()) {
-	getReq, err := http.NewRequestWithContext(ctx, "GET", p.config.UpstreamURLGET, nil)
+func (p *Proxy) handleV2Download(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort, sessionID, protocolV2 string, connMutex *sync.Mutex, closeOnce *sync.Once, tunnelClose func()) {
+	logger := loggerFrom(ctx)
+	tunnel := tunnelFrom(ctx)
+	getReq, err := http.NewRequestWithContext(ctx, "GET", up.config.URLGET, nil)
 	if err != nil {
-		log.Printf("%s [%s] Failed to create GET request: %v", logPrefixError, protocolV2, err)
+		logger.Error("Failed to create GET request", "error", err)
+		tunnel.closing(closeStreamError)
 		closeOnce.Do(tunnelClose)
 		return
 	}
-	p.setTunnelHeaders(getReq, targetHost, targetPort, sessionID)
+	up.setTunnelHeaders(getReq, targetHost, targetPort, sessionID)
 
-	getResp, err := p.httpClientGET.Do(getReq)
+	start := time.Now()
+	getResp, err := up.httpClientGET.Do(getReq)
 	if err != nil {
+		logger.Log(ctx, errorLevel(err), "GET request failed", "error", err)
+		tunnel.closing(upstreamErrorReason(err))
 		if !isExpectedError(err) {
-			log.Printf("%s [%s] GET request failed: %v", logPrefixError, protocolV2, err)
+			up.reportV2Failure()
+			p.metrics.upstreamFailure(up.config.Name, nil)
 		}
 		closeOnce.Do(tunnelClose)
 		return
 	}
 	defer getResp.Body.Close()
+	p.metrics.observeLatency(up.httpVersionGET, start)
+	tunnel.recordResponse("GET", up.httpVersionGET, getResp.StatusCode)
 
 	if getResp.StatusCode != http.StatusOK {
-		log.Printf("%s [%s] Upstream GET failed with status: %s", logPrefixError, protocolV2, getResp.Status)
+		logger.Warn("Upstream GET failed", "status", getResp.Status)
+		tunnel.closing(closeUpstreamStatus)
+		p.metrics.upstreamFailure(up.config.Name, getResp)
+		up.learnCapabilities(getResp.Header)
+		up.reportV2Failure()
 		closeOnce.Do(tunnelClose)
 		return
 	}
-	log.Printf("%s [%s] Upstream GET tunnel established", logPrefixTunnel, protocolV2)
+	up.reportSuccess()
+	up.reportV2Success()
+	up.learnCapabilities(getResp.Header)
+	logger.Debug("Upstream GET tunnel established")
+	tunnel.established()
 
 	buf := make([]byte, bufferSize)
 	connMutex.Lock()
 	_, err = io.CopyBuffer(clientConn, getResp.Body, buf)
 	connMutex.Unlock()
-	if err != nil && !isExpectedError(err) {
-		log.Printf("%s [%s] Stream error: %v", logPrefixError, protocolV2, err)
+	if err != nil {
+		logger.Log(ctx, errorLevel(err), "Stream error", "error", err)
 	}
+	tunnel.closing(closeReasonFor(err))
 	closeOnce.Do(tunnelClose)
 }
 
+// ============================================================================
+// HTTP Forward Handler
+// ============================================================================
+
+// hopHeaders are stripped from forwarded requests and responses (RFC 9110 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func (p *Proxy) handleForward(w http.ResponseWriter, r *http.Request, upstream string) {
+	logger := slog.With("protocol", "http", "client", r.RemoteAddr, "method", r.Method, "url", r.URL.Redacted())
+	logger.Debug("Forward request")
+
+	if r.URL.Scheme != "http" {
+		logger.Warn("Unsupported scheme")
+		http.Error(w, "Unsupported scheme", http.StatusBadRequest)
+		return
+	}
+
+	outReq := r.Clone(context.WithValue(r.Context(), forwardClientKey{}, r.RemoteAddr))
+	outReq.RequestURI = ""
+	outReq.Close = false
+	if r.ContentLength == 0 {
+		outReq.Body = nil
+	}
+	removeHopHeaders(outReq.Header)
+
+	resp, err := p.forwardTransport(upstream).RoundTrip(outReq)
+	if errors.Is(err, errBlockedByRule) {
+		logger.Info("Request blocked by rule")
+		http.Error(w, "Blocked by proxy rule", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.Log(r.Context(), errorLevel(err), "Forward request failed", "error", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	buf := make([]byte, bufferSize)
+	_, err = io.CopyBuffer(flushWriter{w}, resp.Body, buf)
+	if err != nil {
+		logger.Log(r.Context(), errorLevel(err), "Stream error", "error", err)
+	}
+	logger.Info("Forwarded request", "status", resp.Status)
+}
+
+// forwardClientKey carries the address of the client whose forwarded request
+// made the transport dial, so that the tunnel is recorded under that client.
+type forwardClientKey struct{}
+
+// dialTunnel opens a tunnel to addr, or a direct connection if a rule says
+// so, and returns the local end of it, so that forwarded requests can be sent
+// with a regular keep-alive http.Transport. upstream is used unless a rule
+// names another one.
+func (p *Proxy) dialTunnel(dialCtx context.Context, addr, upstream string) (net.Conn, error) {
+	targetHost, targetPort, err := parseAndFormatTarget(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var targetConn net.Conn
+	rt := p.routeFor(addr)
+	switch rt.action {
+	case routeBlock:
+		return nil, errBlockedByRule
+	case routeDirect:
+		if targetConn, err = p.dialDirect(dialCtx, targetHost, targetPort); err != nil {
+			return nil, err
+		}
+	}
+	if rt.upstream == "" {
+		rt.upstream = upstream
+	}
+
+	local, remote := net.Pipe()
+	var clientConn net.Conn = remote
+	if client, ok := dialCtx.Value(forwardClientKey{}).(string); ok {
+		if addr, err := netip.ParseAddrPort(client); err == nil {
+			clientConn = &clientAddrConn{Conn: remote, addr: net.TCPAddrFromAddrPort(addr)}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer remote.Close()
+		defer cancel()
+		if targetConn != nil {
+			p.relayDirect(ctx, clientConn, targetConn, targetHost, targetPort)
+			return
+		}
+		p.tunnel(ctx, p.upstreamFor(rt), clientConn, targetHost, targetPort)
+	}()
+	return &tunnelConn{Conn: local, cancel: cancel}, nil
+}
+
+// clientAddrConn reports the forwarding client as the remote address of the
+// pipe end a tunnel reads from.
+type clientAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *clientAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// tunnelConn cancels the tunnel when the transport discards the connection.
+type tunnelConn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *tunnelConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, token := range h.Values("Connection") {
+		for _, name := range strings.Split(token, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
 // ============================================================================
 // Helper Functions
 // ============================================================================
@@ -425,7 +998,12 @@ func extractPort(u *url.URL) string {
 	return "80"
 }
 
-func autoDetectHTTPVersion(scheme string, isGET bool) string {
+// resolveHTTPVersion maps an empty or "auto" version to the default for the
+// URL scheme and direction.
+func resolveHTTPVersion(httpVersion, scheme string, isGET bool) string {
+	if httpVersion != "" && httpVersion != "auto" {
+		return httpVersion
+	}
 	if scheme == "https" {
 		if isGET {
 			return "h3"
@@ -470,24 +1048,15 @@ func hijackAndRespond(w http.ResponseWriter, streamTimeout time.Duration) (net.C
 	return conn, nil
 }
 
-func (p *Proxy) setTunnelHeaders(req *http.Request, targetHost, targetPort, sessionID string) {
-	req.Header.Set("Authorization", "Basic "+p.config.AuthToken)
-	req.Header.Set("X-Target-Host", targetHost)
-	req.Header.Set("X-Target-Port", targetPort)
-	req.Header.Set("Content-Type", "application/grpc")
-	req.Header.Set("Cache-Control", "no-cache")
-	if sessionID != "" {
-		req.Header.Set("X-Session-ID", sessionID)
-	}
-}
-
 func isExpectedError(err error) bool {
 	if err == nil {
 		return true
 	}
 	return errors.Is(err, context.Canceled) ||
 		errors.Is(err, net.ErrClosed) ||
-		strings.Contains(err.Error(), "H3_REQUEST_CANCELLED")
+		errors.Is(err, io.ErrClosedPipe) ||
+		strings.Contains(err.Error(), "H3_REQUEST_CANCELLED") ||
+		strings.Contains(err.Error(), "client disconnected")
 }
 
 func generateSessionID() string {
@@ -500,77 +1069,332 @@ func generateSessionID() string {
 }
 
 // ============================================================================
-// Main Entry Point
+// Command-Line Flags
 // ============================================================================
 
-func main() {
-	cfg := Config{}
-	var urlBoth, httpVersionBoth string
-	var showVersion bool
+// flagOptions holds flags that are not Config fields themselves: shorthands
+// expanded into per-direction settings and the config file selection.
+type flagOptions struct {
+	urlBoth         string
+	httpVersionBoth string
+	sniBoth         string
+	hostBoth        string
+	pins            string
+	allow           string
+	tokenFile       string
+	configFile      string
+	profile         string
+	showVersion     bool
+}
+
+func newFlagSet(cfg *Config, opts *flagOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+
+	// Config File
+	fs.StringVar(&opts.configFile, "config", os.Getenv("TWOPASS_CONFIG"), "JSON config file with named profiles (default $TWOPASS_CONFIG)")
+	fs.StringVar(&opts.profile, "profile", "", "Config file profile to use (default: the file's default_profile)")
 
 	// Server Configuration
-	flag.StringVar(&cfg.ListenAddr, "listen", "127.0.0.1:8080", "Local proxy listen address (host:port)")
-	flag.IntVar(&cfg.Version, "version", 2, "Protocol version: 1 (single stream) or 2 (dual stream)")
+	fs.StringVar(&cfg.ListenAddr, "listen", "127.0.0.1:8080", "Local proxy listen address (host:port)")
+	fs.StringVar(&cfg.SOCKSListenAddr, "socks", "", "Local SOCKS5 listen address (host:port, empty = disabled)")
+	fs.StringVar(&cfg.SOCKSUsername, "socks-user", "", "SOCKS5 username (enables username/password auth)")
+	fs.StringVar(&cfg.SOCKSPassword, "socks-pass", "", "SOCKS5 password")
+	fs.BoolVar(&cfg.MixedMode, "mixed", false, "Accept both HTTP and SOCKS5 clients on the -listen address")
+	fs.StringVar(&cfg.TransparentAddr, "transparent", "", "Transparent proxy listen address for iptables/nftables REDIRECT, Linux only (host:port, empty = disabled)")
+	fs.BoolVar(&cfg.Sniff, "sniff", false, "Replace IP targets of transparent and SOCKS5 connections with the TLS SNI or HTTP Host the client sends")
+	fs.StringVar(&cfg.MetricsAddr, "metrics", "", "Prometheus metrics listen address (host:port, empty = disabled)")
+	fs.StringVar(&cfg.AdminAddr, "admin", "", "Admin API listen address (host:port or :port for localhost, empty = disabled)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("TWOPASS_ADMIN_TOKEN"), "Bearer token for the admin API (required with -admin, default $TWOPASS_ADMIN_TOKEN)")
+	fs.StringVar(&cfg.ProxyUsersFile, "proxy-users", "", "Require credentials from HTTP and SOCKS5 clients; file of user:password[:upstream] lines")
+	fs.StringVar(&opts.allow, "allow", "", "Comma-separated client IPs or CIDRs allowed to use the proxy listeners (empty = any)")
+	fs.IntVar(&cfg.Version, "version", 2, "Protocol version: 1 (single stream), 2 (dual stream) or 0 (auto-negotiate)")
+	fs.DurationVar(&cfg.FallbackCooldown, "fallback-cooldown", 5*time.Minute, "Use V1 for this long after repeated V2 failures (0 = never fall back)")
 
 	// Upstream Server Configuration
-	flag.StringVar(&urlBoth, "url", "", "Upstream URL for both POST and GET (shorthand)")
-	flag.StringVar(&cfg.UpstreamURLPOST, "url-post", "", "Upstream URL for POST/upload stream")
-	flag.StringVar(&cfg.UpstreamURLGET, "url-get", "", "Upstream URL for GET/download stream")
-	flag.StringVar(&cfg.UpstreamAddr, "addr", "", "Override upstream IP address (bypasses DNS)")
-	flag.StringVar(&cfg.AuthToken, "token", "", "Authentication token (required)")
+	fs.StringVar(&opts.urlBoth, "url", "", "Upstream URL for both POST and GET (shorthand)")
+	fs.StringVar(&cfg.UpstreamURLPOST, "url-post", "", "Upstream URL for POST/upload stream")
+	fs.StringVar(&cfg.UpstreamURLGET, "url-get", "", "Upstream URL for GET/download stream")
+	fs.StringVar(&cfg.UpstreamAddr, "addr", "", "Override upstream IP address (bypasses DNS)")
+	fs.StringVar(&cfg.AuthToken, "token", os.Getenv("TWOPASS_TOKEN"), "Authentication token (required, default $TWOPASS_TOKEN)")
+	fs.StringVar(&opts.tokenFile, "token-file", "", "Read the authentication token from this file (overrides -token)")
+	fs.StringVar(&cfg.AuthScheme, "auth", authBasic, "Authentication scheme: basic (raw token) or hmac (signed, time-limited)")
+	fs.Var((*upstreamList)(&cfg.Upstreams), "upstream", "Additional upstream as name=,url=,url-post=,url-get=,token=,token-file=,auth=,http=,http-post=,http-get=,addr=,sni=,host= (repeatable)")
+	fs.StringVar(&cfg.UpstreamPolicy, "upstream-policy", policyFailover, "Upstream selection policy: failover, round-robin, lowest-latency")
+	fs.DurationVar(&cfg.HealthInterval, "health-interval", 30*time.Second, "Upstream health probe interval (0 = disabled)")
+	fs.DurationVar(&cfg.HealthTimeout, "health-timeout", 5*time.Second, "Upstream health probe timeout")
+
+	// Routing
+	fs.Var((*ruleList)(&cfg.Rules), "rule", "Routing rule as matcher,value,action; matchers: domain-suffix, domain-keyword, regex, cidr, port, rule-file; actions: tunnel, tunnel:<upstream>, direct, block (repeatable, first match wins)")
+	cfg.DefaultRoute = route{action: routeTunnel}
+	fs.Var(&cfg.DefaultRoute, "default-route", "Route for targets no -rule matches: tunnel, tunnel:<upstream>, direct or block")
 
 	// HTTP Protocol Configuration
-	flag.StringVar(&httpVersionBoth, "http", "auto", "HTTP version for both streams: auto, h2, h2c, h3")
-	flag.StringVar(&cfg.HTTPVersionPOST, "http-post", "", "HTTP version for POST stream (overrides -http)")
-	flag.StringVar(&cfg.HTTPVersionGET, "http-get", "", "HTTP version for GET stream (overrides -http)")
+	fs.StringVar(&opts.httpVersionBoth, "http", "auto", "HTTP version for both streams: auto, h1, h2, h2c, h3")
+	fs.StringVar(&cfg.HTTPVersionPOST, "http-post", "", "HTTP version for POST stream (overrides -http)")
+	fs.StringVar(&cfg.HTTPVersionGET, "http-get", "", "HTTP version for GET stream (overrides -http)")
+
+	// Domain Fronting
+	fs.StringVar(&opts.sniBoth, "sni", "", "TLS SNI for both streams (default: URL hostname)")
+	fs.StringVar(&cfg.SNIPOST, "sni-post", "", "TLS SNI for POST stream (overrides -sni)")
+	fs.StringVar(&cfg.SNIGET, "sni-get", "", "TLS SNI for GET stream (overrides -sni)")
+	fs.StringVar(&opts.hostBoth, "host", "", "Host header for both streams (default: URL host)")
+	fs.StringVar(&cfg.HostPOST, "host-post", "", "Host header for POST stream (overrides -host)")
+	fs.StringVar(&cfg.HostGET, "host-get", "", "Host header for GET stream (overrides -host)")
+
+	// Multiplexing and Transfer Modes
+	fs.BoolVar(&cfg.Mux, "mux", false, "Multiplex all tunnels over one long-lived upstream session")
+	fs.StringVar(&cfg.UploadMode, "upload-mode", uploadModeStream, "V2 upload mode: stream (one streaming POST) or packet (sequence-numbered POSTs)")
+	fs.IntVar(&cfg.PacketSize, "packet-size", 64*1024, "Maximum bytes per POST in packet upload mode")
+	fs.StringVar(&cfg.DownloadMode, "download-mode", downloadModeStream, "V2 download mode: stream (one streaming GET) or poll (successive long-poll GETs)")
 
 	// Connection Settings
-	flag.BoolVar(&cfg.InsecureSkipVerify, "insecure", true, "Skip TLS certificate verification")
-	flag.DurationVar(&cfg.ConnTimeout, "conn-timeout", 10*time.Second, "TCP connection timeout")
-	flag.DurationVar(&cfg.StreamTimeout, "stream-timeout", 0, "Stream timeout (0 = unlimited)")
+	fs.BoolVar(&cfg.InsecureSkipVerify, "insecure", true, "Skip TLS certificate verification")
+	fs.StringVar(&cfg.CAFile, "ca-file", "", "Verify upstream certificates against this PEM CA bundle (implies -insecure=false)")
+	fs.StringVar(&opts.pins, "pin", "", "Comma-separated SPKI SHA-256 pins (sha256/<base64>); one must match the upstream chain")
+	fs.StringVar(&cfg.TOFUFile, "tofu-file", "", "Trust-on-first-use store: record each upstream's key and reject changes")
+	fs.StringVar(&cfg.ClientCertFile, "client-cert", "", "PEM client certificate for mTLS upstreams")
+	fs.StringVar(&cfg.ClientKeyFile, "client-key", "", "PEM private key for -client-cert")
+	fs.StringVar(&cfg.ClientKeyPassphrase, "client-key-pass", os.Getenv("TWOPASS_KEY_PASSPHRASE"), "Passphrase for an encrypted -client-key (default $TWOPASS_KEY_PASSPHRASE)")
+	fs.DurationVar(&cfg.ConnTimeout, "conn-timeout", 10*time.Second, "TCP connection and client handshake timeout")
+	fs.DurationVar(&cfg.StreamTimeout, "stream-timeout", 0, "Stream timeout (0 = unlimited)")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "On SIGTERM/SIGINT, wait this long for active tunnels before closing them")
+
+	// Logging
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "Log level: debug, info, warn, error")
+	fs.StringVar(&cfg.LogFormat, "log-format", logFormatText, "Log format: text or json")
+	fs.StringVar(&cfg.AccessLog, "access-log", "", "Write one JSON record per tunnel to this file (- = stdout, empty = disabled)")
+	fs.IntVar(&cfg.AccessLogMaxSize, "access-log-max-size", 100, "Rotate the access log file when it reaches this many MB (0 = never)")
+	fs.IntVar(&cfg.AccessLogBackups, "access-log-backups", 5, "Rotated access log files to keep")
 
 	// Misc
-	flag.BoolVar(&showVersion, "v", false, "Show version and exit")
-	flag.Parse()
+	fs.BoolVar(&opts.showVersion, "v", false, "Show version and exit")
+	return fs
+}
 
-	if showVersion {
-		fmt.Printf("TwoPass Client %s\n", Version)
-		return
+// parsedConfig is the outcome of parseConfig: the effective Config plus what
+// `config check` needs to explain where each value came from.
+type parsedConfig struct {
+	config      Config
+	flags       *flag.FlagSet
+	sources     map[string]string
+	configFile  string
+	profile     string
+	showVersion bool
+}
+
+// parseConfig builds the effective configuration from args and, with
+// -config, one profile of a config file. Explicit flags win over the profile,
+// which wins over flag defaults. It is re-run on every SIGHUP.
+func parseConfig(args []string) (*parsedConfig, error) {
+	cfg := Config{}
+	opts := flagOptions{}
+	fs := newFlagSet(&cfg, &opts)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	pc := &parsedConfig{flags: fs, sources: make(map[string]string), configFile: opts.configFile, showVersion: opts.showVersion}
+	fs.Visit(func(f *flag.Flag) { pc.sources[f.Name] = sourceFlag })
+	if opts.configFile != "" {
+		profile, err := applyConfigFile(fs, opts.configFile, opts.profile, pc.sources)
+		if err != nil {
+			return nil, err
+		}
+		pc.profile = profile
+	}
+	if opts.showVersion {
+		return pc, nil
 	}
 
-	if urlBoth != "" {
+	if opts.urlBoth != "" {
 		if cfg.UpstreamURLPOST == "" {
-			cfg.UpstreamURLPOST = urlBoth
+			cfg.UpstreamURLPOST = opts.urlBoth
 		}
 		if cfg.UpstreamURLGET == "" {
-			cfg.UpstreamURLGET = urlBoth
+			cfg.UpstreamURLGET = opts.urlBoth
+		}
+	}
+
+	if opts.tokenFile != "" {
+		token, err := readTokenFile(opts.tokenFile)
+		if err != nil {
+			return nil, err
 		}
+		cfg.AuthToken = token
 	}
 
-	if httpVersionBoth != "" && httpVersionBoth != "auto" {
+	if opts.httpVersionBoth != "" && opts.httpVersionBoth != "auto" {
 		if cfg.HTTPVersionPOST == "" {
-			cfg.HTTPVersionPOST = httpVersionBoth
+			cfg.HTTPVersionPOST = opts.httpVersionBoth
 		}
 		if cfg.HTTPVersionGET == "" {
-			cfg.HTTPVersionGET = httpVersionBoth
+			cfg.HTTPVersionGET = opts.httpVersionBoth
+		}
+	}
+
+	if opts.pins != "" {
+		for _, pin := range strings.Split(opts.pins, ",") {
+			cfg.Pins = append(cfg.Pins, strings.TrimSpace(pin))
+		}
+	}
+
+	if opts.sniBoth != "" {
+		if cfg.SNIPOST == "" {
+			cfg.SNIPOST = opts.sniBoth
+		}
+		if cfg.SNIGET == "" {
+			cfg.SNIGET = opts.sniBoth
+		}
+	}
+
+	if opts.hostBoth != "" {
+		if cfg.HostPOST == "" {
+			cfg.HostPOST = opts.hostBoth
+		}
+		if cfg.HostGET == "" {
+			cfg.HostGET = opts.hostBoth
 		}
 	}
 
-	if cfg.UpstreamURLPOST == "" || cfg.UpstreamURLGET == "" || cfg.AuthToken == "" {
-		flag.Usage()
-		log.Fatalf("%s Upstream URLs and Authentication token are required.", logPrefixError)
+	if err := validateUpstreams(cfg.upstreamConfigs()); err != nil {
+		return nil, err
 	}
 
-	if cfg.Version != 1 && cfg.Version != 2 {
-		log.Fatalf("%s Invalid protocol version specified. Must be 1 or 2.", logPrefixError)
+	if cfg.ProxyUsersFile != "" {
+		users, err := loadProxyUsers(cfg.ProxyUsersFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ProxyUsers = users
+	}
+
+	if opts.allow != "" {
+		for _, entry := range strings.Split(opts.allow, ",") {
+			prefix, err := parsePrefix(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, fmt.Errorf("invalid -allow entry: %w", err)
+			}
+			cfg.AllowedClients = append(cfg.AllowedClients, prefix)
+		}
 	}
 
-	log.Printf("%s HTTP proxy server starting... (version %s)", logPrefixInfo, Version)
-	proxy, err := NewProxy(cfg)
+	if err := validateRoutes(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.TransparentAddr != "" && !transparentSupported {
+		return nil, errors.New("-transparent is only supported on Linux")
+	}
+
+	if cfg.AdminAddr != "" {
+		if cfg.AdminToken == "" {
+			return nil, errors.New("-admin requires -admin-token")
+		}
+		host, port, err := net.SplitHostPort(cfg.AdminAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin address: %w", err)
+		}
+		if host == "" {
+			cfg.AdminAddr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	switch cfg.UpstreamPolicy {
+	case policyFailover, policyRoundRobin, policyLowestLatency:
+	default:
+		return nil, fmt.Errorf("invalid upstream policy: %s", cfg.UpstreamPolicy)
+	}
+
+	if cfg.UploadMode != uploadModeStream && cfg.UploadMode != uploadModePacket {
+		return nil, fmt.Errorf("invalid upload mode: %s", cfg.UploadMode)
+	}
+	if cfg.DownloadMode != downloadModeStream && cfg.DownloadMode != downloadModePoll {
+		return nil, fmt.Errorf("invalid download mode: %s", cfg.DownloadMode)
+	}
+	if cfg.PacketSize <= 0 || cfg.PacketSize > maxPacketSize {
+		return nil, fmt.Errorf("packet size must be between 1 and %d bytes", maxPacketSize)
+	}
+
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	if cfg.LogFormat != logFormatText && cfg.LogFormat != logFormatJSON {
+		return nil, fmt.Errorf("invalid log format: %s", cfg.LogFormat)
+	}
+	if cfg.AccessLogMaxSize < 0 || cfg.AccessLogBackups < 0 {
+		return nil, errors.New("-access-log-max-size and -access-log-backups must not be negative")
+	}
+
+	if cfg.Version < 0 || cfg.Version > 2 {
+		return nil, errors.New("invalid protocol version specified, must be 0, 1 or 2")
+	}
+
+	pc.config = cfg
+	return pc, nil
+}
+
+// ============================================================================
+// Main Entry Point
+// ============================================================================
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "server" {
+		runServer(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		runConfigCheck(os.Args[3:])
+		return
+	}
+
+	pc, err := parseConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("%s Failed to create proxy: %v", logPrefixError, err)
+		fatal("Invalid configuration", "error", err)
+	}
+
+	if pc.showVersion {
+		fmt.Printf("TwoPass Client %s\n", Version)
+		return
+	}
+
+	if err := setupLogging(pc.config.LogLevel, pc.config.LogFormat); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	slog.Info("HTTP proxy server starting...", "version", Version)
+	if pc.profile != "" {
+		slog.Info("Using config profile", "profile", pc.profile)
 	}
-	if err := proxy.Start(); err != nil {
-		log.Fatalf("%s Failed to start proxy server: %v", logPrefixError, err)
+	proxy, err := NewProxy(pc.config)
+	if err != nil {
+		fatal("Failed to create proxy", "error", err)
+	}
+	go proxy.reloadOnSIGHUP(os.Args[1:])
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- proxy.Start()
+	}()
+
+	select {
+	case err := <-errCh:
+		fatal("Failed to start proxy server", "error", err)
+	case sig := <-signals:
+		drainTimeout := proxy.current().config.DrainTimeout
+		slog.Info("Received signal, stopping (signal again to force)", "signal", sig.String(), "drain_timeout", drainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		go func() {
+			<-signals
+			cancel()
+		}()
+		proxy.Shutdown(ctx)
+		cancel()
+		if proxy.accessLog != nil {
+			proxy.accessLog.Close()
+		}
 	}
 }
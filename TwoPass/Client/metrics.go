@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Metrics
+// ============================================================================
+//
+// A small Prometheus text-format (0.0.4) exporter, enough for counters,
+// one gauge and one histogram without pulling in client_golang. Metrics are
+// shared by every proxy generation, so they survive a SIGHUP reload.
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// latencyBuckets are the upper bounds, in seconds, of the upstream request
+// latency histogram.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metrics struct {
+	tunnelsOpened    counterVec // protocol
+	tunnelsClosed    counterVec // protocol
+	bytesUploaded    counterVec // protocol
+	bytesDownloaded  counterVec // protocol
+	upstreamFailures counterVec // upstream, status
+	upstreamLatency  histogramVec
+
+	// activeTunnels reports the gauge at scrape time.
+	activeTunnels func() int
+}
+
+func newMetrics(activeTunnels func() int) *metrics {
+	return &metrics{activeTunnels: activeTunnels}
+}
+
+// trackTunnel counts a tunnel as opened and returns the function that counts
+// it as closed.
+func (m *metrics) trackTunnel(protocol string) func() {
+	m.tunnelsOpened.with(protocol).Add(1)
+	return func() { m.tunnelsClosed.with(protocol).Add(1) }
+}
+
+// countConn counts bytes read from the client as uploaded and bytes written
+// to it as downloaded, both per protocol and for the tunnel itself.
+func (m *metrics) countConn(conn net.Conn, protocol string, tunnel *liveTunnel) net.Conn {
+	return &countingConn{
+		Conn:       conn,
+		up:         m.bytesUploaded.with(protocol),
+		down:       m.bytesDownloaded.with(protocol),
+		tunnelUp:   &tunnel.bytesUp,
+		tunnelDown: &tunnel.bytesDown,
+	}
+}
+
+// upstreamFailure records a failed upstream request: status is the HTTP
+// status code, or "error" when no response was received.
+func (m *metrics) upstreamFailure(upstream string, resp *http.Response) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	m.upstreamFailures.with(upstream, status).Add(1)
+}
+
+// upstreamError counts a failed upstream request from its error, labelled
+// with the status of an errUpstreamStatus. Expected errors, such as the client
+// going away, are not failures.
+func (m *metrics) upstreamError(upstream string, err error) {
+	var statusErr *upstreamStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		m.upstreamFailures.with(upstream, strconv.Itoa(statusErr.code)).Add(1)
+	case !isExpectedError(err):
+		m.upstreamFailures.with(upstream, "error").Add(1)
+	}
+}
+
+// observeLatency records the time until upstream response headers arrived.
+func (m *metrics) observeLatency(httpVersion string, start time.Time) {
+	m.upstreamLatency.observe(httpVersion, time.Since(start).Seconds())
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+
+	writeHeader(w, "twopass_tunnels_active", "gauge", "Tunnels currently open.")
+	fmt.Fprintf(w, "twopass_tunnels_active %d\n", m.activeTunnels())
+
+	m.tunnelsOpened.write(w, "twopass_tunnels_opened_total", "Tunnels opened, by protocol.", "protocol")
+	m.tunnelsClosed.write(w, "twopass_tunnels_closed_total", "Tunnels closed, by protocol.", "protocol")
+	m.bytesUploaded.write(w, "twopass_upload_bytes_total", "Bytes read from clients and sent upstream, by protocol.", "protocol")
+	m.bytesDownloaded.write(w, "twopass_download_bytes_total", "Bytes received from upstream and written to clients, by protocol.", "protocol")
+	m.upstreamFailures.write(w, "twopass_upstream_failures_total", "Failed upstream requests, by upstream and status code.", "upstream", "status")
+	m.upstreamLatency.write(w, "twopass_upstream_request_duration_seconds", "Time until upstream response headers, by HTTP version.", "http_version")
+}
+
+// startMetrics serves /metrics on addr.
+func (p *Proxy) startMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.metrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+	p.addServer(server)
+	slog.Info("Serving metrics", "url", "http://"+addr+"/metrics")
+	return server.ListenAndServe()
+}
+
+// ============================================================================
+// Metric Types
+// ============================================================================
+
+// counterVec is a set of counters keyed by label values.
+type counterVec struct {
+	mu       sync.Mutex
+	counters map[string]*atomic.Uint64
+	labels   map[string][]string
+}
+
+func (c *counterVec) with(labels ...string) *atomic.Uint64 {
+	key := strings.Join(labels, "\x00")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if counter, ok := c.counters[key]; ok {
+		return counter
+	}
+	if c.counters == nil {
+		c.counters = make(map[string]*atomic.Uint64)
+		c.labels = make(map[string][]string)
+	}
+	counter := new(atomic.Uint64)
+	c.counters[key] = counter
+	c.labels[key] = labels
+	return counter
+}
+
+func (c *counterVec) write(w io.Writer, name, help string, labelNames ...string) {
+	writeHeader(w, name, "counter", help)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.counters) {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(labelNames, c.labels[key]), c.counters[key].Load())
+	}
+}
+
+// histogramVec is a set of latencyBuckets histograms keyed by one label.
+type histogramVec struct {
+	mu         sync.Mutex
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	buckets []uint64 // cumulative counts are computed at scrape time
+	count   uint64
+	sum     float64
+}
+
+func (h *histogramVec) observe(label string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.histograms == nil {
+		h.histograms = make(map[string]*histogram)
+	}
+	hist, ok := h.histograms[label]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		h.histograms[label] = hist
+	}
+	if i, _ := slices.BinarySearch(latencyBuckets, value); i < len(latencyBuckets) {
+		hist.buckets[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer, name, help, labelName string) {
+	writeHeader(w, name, "histogram", help)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, label := range sortedKeys(h.histograms) {
+		hist := h.histograms[label]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += hist.buckets[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels([]string{labelName, "le"}, []string{label, le}), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels([]string{labelName, "le"}, []string{label, "+Inf"}), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, formatLabels([]string{labelName}, []string{label}), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels([]string{labelName}, []string{label}), hist.count)
+	}
+}
+
+func writeHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// countingConn adds the bytes passing through a client connection to the
+// upload and download counters.
+type countingConn struct {
+	net.Conn
+	up, down             *atomic.Uint64
+	tunnelUp, tunnelDown *atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.up.Add(uint64(n))
+	c.tunnelUp.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.down.Add(uint64(n))
+	c.tunnelDown.Add(uint64(n))
+	return n, err
+}
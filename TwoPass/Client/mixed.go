@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Mixed Listener (HTTP + SOCKS5 on one port)
+// ============================================================================
+
+// startMixed accepts connections on the HTTP listen address and routes each one
+// by its first byte: 0x05 starts a SOCKS5 handshake, anything else is HTTP.
+func (p *Proxy) startMixed(server *http.Server) error {
+	listener, err := net.Listen("tcp", p.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	p.addListener(listener)
+	slog.Info("Mixed mode enabled: HTTP and SOCKS5 share the listen address", "addr", p.config.ListenAddr)
+
+	httpListener := newConnListener(listener.Addr())
+	go server.Serve(httpListener)
+	defer httpListener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.routeMixed(conn, httpListener)
+	}
+}
+
+func (p *Proxy) routeMixed(conn net.Conn, httpListener *connListener) {
+	pc := &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+	if timeout := p.current().config.ConnTimeout; timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if first[0] == socks5Version {
+		p.current().handleSOCKS5(pc)
+		return
+	}
+	if !httpListener.push(pc) {
+		conn.Close()
+	}
+}
+
+// peekConn replays bytes buffered while sniffing the protocol.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a net.Listener fed with connections that were accepted elsewhere.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ============================================================================
+// Mux Protocol
+// ============================================================================
+//
+// A mux session carries many logical streams inside one long-lived upload
+// body and one download body (a single POST for V1, a POST/GET pair for V2).
+// Every frame starts with a 9-byte header:
+//
+//	type (1) | stream ID (4) | payload length (4)
+//
+// OPEN carries the target as "host:port", DATA carries stream bytes, CLOSE
+// ends a stream (optionally with a reason) and WINDOW grants the peer more
+// send credit as a big-endian uint32.
+
+const (
+	protocolMux = "mux"
+	muxVersion  = "1"
+
+	muxFrameOpen   = 0x01
+	muxFrameData   = 0x02
+	muxFrameClose  = 0x03
+	muxFrameWindow = 0x04
+
+	muxHeaderSize     = 9
+	muxMaxPayload     = 64 * 1024
+	muxInitialWindow  = 256 * 1024
+	muxWindowUpdateAt = muxInitialWindow / 2
+)
+
+var errMuxSessionClosed = errors.New("mux session closed")
+
+type muxSession struct {
+	id      string
+	w       io.WriteCloser
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  atomic.Uint32
+	closed  bool
+	retired bool
+	done    chan struct{}
+
+	// onOpen is called for streams opened by the peer (server side only).
+	onOpen func(stream *muxStream, target string)
+}
+
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	recvBuf    bytes.Buffer
+	recvWindow int // credit granted to the peer and not yet used
+	consumed   int
+	sendWindow int
+	closed     bool
+	reason     string
+	closeOnce  sync.Once
+}
+
+func newMuxSession(id string, w io.WriteCloser, onOpen func(*muxStream, string)) *muxSession {
+	return &muxSession{
+		id:      id,
+		w:       w,
+		streams: make(map[uint32]*muxStream),
+		done:    make(chan struct{}),
+		onOpen:  onOpen,
+	}
+}
+
+// ============================================================================
+// Mux Session
+// ============================================================================
+
+func (s *muxSession) writeFrame(frameType byte, streamID uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], streamID)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.isClosed() {
+		return errMuxSessionClosed
+	}
+	_, err := s.w.Write(frame)
+	return err
+}
+
+// Open starts a new logical stream to target.
+func (s *muxSession) Open(target string) (*muxStream, error) {
+	stream := s.newStream(s.nextID.Add(1))
+	if stream == nil {
+		return nil, errMuxSessionClosed
+	}
+	if err := s.writeFrame(muxFrameOpen, stream.id, []byte(target)); err != nil {
+		stream.closeLocal()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *muxSession) newStream(id uint32) *muxStream {
+	stream := &muxStream{id: id, session: s, recvWindow: muxInitialWindow, sendWindow: muxInitialWindow}
+	stream.cond = sync.NewCond(&stream.mu)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.streams[id] = stream
+	return stream
+}
+
+func (s *muxSession) stream(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	idle := s.retired && len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+// retire closes the session once its last stream has ended.
+func (s *muxSession) retire() {
+	s.mu.Lock()
+	s.retired = true
+	idle := len(s.streams) == 0
+	s.mu.Unlock()
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *muxSession) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// readLoop decodes frames from the download body until it fails, then closes the session.
+func (s *muxSession) readLoop(r io.Reader) error {
+	defer s.Close()
+
+	header := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return err
+		}
+		frameType := header[0]
+		streamID := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		if length > muxMaxPayload {
+			return fmt.Errorf("mux frame too large: %d", length)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+
+		switch frameType {
+		case muxFrameOpen:
+			if s.onOpen == nil {
+				return errors.New("unexpected mux OPEN frame")
+			}
+			if s.stream(streamID) != nil {
+				return fmt.Errorf("duplicate mux stream ID: %d", streamID)
+			}
+			if stream := s.newStream(streamID); stream != nil {
+				go s.onOpen(stream, string(payload))
+			}
+		case muxFrameData:
+			if stream := s.stream(streamID); stream != nil {
+				if err := stream.receive(payload); err != nil {
+					return err
+				}
+			}
+		case muxFrameClose:
+			if stream := s.stream(streamID); stream != nil {
+				stream.closeRemote(string(payload))
+			}
+		case muxFrameWindow:
+			if stream := s.stream(streamID); stream != nil && length == 4 {
+				stream.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+		default:
+			return fmt.Errorf("unknown mux frame type: %d", frameType)
+		}
+	}
+}
+
+func (s *muxSession) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	close(s.done)
+	s.w.Close()
+	for _, stream := range streams {
+		stream.closeRemote(errMuxSessionClosed.Error())
+	}
+}
+
+// ============================================================================
+// Mux Stream
+// ============================================================================
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for st.recvBuf.Len() == 0 && !st.closed {
+		st.cond.Wait()
+	}
+	if st.recvBuf.Len() == 0 {
+		st.mu.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := st.recvBuf.Read(b)
+	st.consumed += n
+	var update int
+	if st.consumed >= muxWindowUpdateAt && !st.closed {
+		update, st.consumed = st.consumed, 0
+		st.recvWindow += update
+	}
+	st.mu.Unlock()
+
+	if update > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(update))
+		st.session.writeFrame(muxFrameWindow, st.id, payload)
+	}
+	return n, nil
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.closed {
+			st.cond.Wait()
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := min(len(b), st.sendWindow, muxMaxPayload)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(muxFrameData, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream locally and tells the peer.
+func (st *muxStream) Close() error {
+	st.closeLocal()
+	return nil
+}
+
+func (st *muxStream) CloseWithReason(reason string) {
+	st.closeOnce.Do(func() {
+		st.markClosed(reason)
+		st.session.writeFrame(muxFrameClose, st.id, []byte(reason))
+	})
+}
+
+func (st *muxStream) closeLocal() {
+	st.CloseWithReason("")
+}
+
+func (st *muxStream) closeRemote(reason string) {
+	st.closeOnce.Do(func() {
+		st.markClosed(reason)
+	})
+}
+
+func (st *muxStream) markClosed(reason string) {
+	st.mu.Lock()
+	st.closed = true
+	st.reason = reason
+	st.cond.Broadcast()
+	st.mu.Unlock()
+	st.session.removeStream(st.id)
+}
+
+func (st *muxStream) closeReason() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.reason
+}
+
+// receive buffers data from the peer. A peer that sends past the window it
+// was granted is broken or hostile, and fails the session.
+func (st *muxStream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	if len(data) > st.recvWindow {
+		return fmt.Errorf("mux stream %d exceeded its receive window", st.id)
+	}
+	st.recvWindow -= len(data)
+	st.recvBuf.Write(data)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *muxStream) grant(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sendWindow += n
+	st.cond.Broadcast()
+}
+
+// relay copies between a and b until either side ends, then closes both.
+func relay(a, b io.ReadWriteCloser) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, bufferSize)
+		io.CopyBuffer(a, b, buf)
+		closeOnce.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, bufferSize)
+		io.CopyBuffer(b, a, buf)
+		closeOnce.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+// ============================================================================
+// Mux Client
+// ============================================================================
+
+// muxClient lazily establishes the shared upstream session and replaces it
+// once it fails.
+type muxClient struct {
+	proxy    *Proxy
+	upstream *upstream
+	mu       sync.Mutex
+	session  *muxSession
+}
+
+func (p *Proxy) handleConnectMux(w http.ResponseWriter, r *http.Request, up *upstream) {
+	slog.Info("Proxy request", "protocol", protocolMux, "client", r.RemoteAddr, "target", r.Host)
+
+	targetHost, targetPort, err := parseAndFormatTarget(r.Host)
+	if err != nil {
+		slog.Warn("Invalid target host format", "protocol", protocolMux, "target", r.Host)
+		http.Error(w, "Invalid target host format", http.StatusBadRequest)
+		return
+	}
+
+	clientConn, err := hijackAndRespond(w, p.config.StreamTimeout)
+	if err != nil {
+		slog.Warn("Hijack failed", "protocol", protocolMux, "error", err)
+		return
+	}
+	defer clientConn.Close()
+
+	p.tunnelMux(r.Context(), up, clientConn, targetHost, targetPort)
+	slog.Debug("Connection closed", "protocol", protocolMux, "target", r.Host)
+}
+
+func (p *Proxy) tunnelMux(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort string) {
+	ctx, clientConn, done := p.openTunnel(ctx, protocolMux, generateSessionID(), up.config.Name, clientConn, targetHost, targetPort)
+	defer done()
+	logger := loggerFrom(ctx)
+	tunnel := tunnelFrom(ctx)
+
+	session, err := up.mux.get()
+	if err != nil {
+		logger.Warn("Failed to establish mux session", "error", err)
+		tunnel.closing(upstreamErrorReason(err))
+		up.reportFailure(err)
+		p.metrics.upstreamError(up.config.Name, err)
+		return
+	}
+
+	target := net.JoinHostPort(targetHost, targetPort)
+	stream, err := session.Open(target)
+	if err != nil {
+		logger.Warn("Failed to open stream", "mux_session", session.id, "error", err)
+		tunnel.closing(closeStreamError)
+		return
+	}
+	logger = logger.With("mux_session", session.id, "stream", stream.id)
+	logger.Debug("Stream opened")
+	httpGET := up.httpVersionGET
+	if up.protocolVersion(p.config.Version) == 1 {
+		httpGET = ""
+	}
+	tunnel.useHTTP(up.httpVersionPOST, httpGET)
+	tunnel.established()
+
+	stop := context.AfterFunc(ctx, func() { stream.Close() })
+	defer stop()
+	relay(clientConn, stream)
+
+	if reason := stream.closeReason(); reason != "" && reason != errMuxSessionClosed.Error() {
+		logger.Warn("Stream closed by upstream", "reason", reason)
+		tunnel.closing(closeStreamError)
+	}
+}
+
+func (m *muxClient) retire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.session != nil {
+		m.session.retire()
+	}
+}
+
+func (m *muxClient) get() (*muxSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.session != nil && !m.session.isClosed() {
+		return m.session, nil
+	}
+
+	session, err := m.proxy.dialMux(m.upstream)
+	if err != nil {
+		return nil, err
+	}
+	m.upstream.reportSuccess()
+	m.session = session
+	return session, nil
+}
+
+func (p *Proxy) dialMux(up *upstream) (*muxSession, error) {
+	sessionID := generateSessionID()
+	logger := slog.With("protocol", protocolMux, "mux_session", sessionID, "upstream", up.config.Name)
+	uploadReader, uploadWriter := io.Pipe()
+	session := newMuxSession(sessionID, uploadWriter, nil)
+
+	ctx, cancel := context.WithCancel(withLogger(context.Background(), logger))
+	go func() {
+		<-session.done
+		cancel()
+	}()
+
+	fail := func(err error) (*muxSession, error) {
+		session.Close()
+		return nil, err
+	}
+
+	if up.protocolVersion(p.config.Version) == 1 {
+		postReq, err := http.NewRequestWithContext(ctx, "POST", up.config.URLPOST, uploadReader)
+		if err != nil {
+			return fail(err)
+		}
+		up.setMuxHeaders(postReq, "")
+
+		resp, err := up.httpClientPOST.Do(postReq)
+		if err != nil {
+			return fail(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fail(errUpstreamStatus(resp))
+		}
+		up.learnCapabilities(resp.Header)
+		go p.runMuxDownload(session, resp.Body)
+		logger.Info("Upstream mux session established")
+		return session, nil
+	}
+
+	go func() {
+		if up.usePacketUpload(p.config.UploadMode) {
+			setHeaders := func(req *http.Request) { up.setMuxHeaders(req, sessionID) }
+			if err := p.uploadPackets(ctx, up, uploadReader, setHeaders); err != nil {
+				logger.Log(ctx, errorLevel(err), "Packet upload failed", "error", err)
+				p.metrics.upstreamError(up.config.Name, err)
+			}
+			session.Close()
+			return
+		}
+
+		postReq, err := http.NewRequestWithContext(ctx, "POST", up.config.URLPOST, uploadReader)
+		if err != nil {
+			session.Close()
+			return
+		}
+		up.setMuxHeaders(postReq, sessionID)
+
+		resp, err := up.httpClientPOST.Do(postReq)
+		if err != nil {
+			logger.Log(ctx, errorLevel(err), "POST request failed", "error", err)
+			p.metrics.upstreamError(up.config.Name, err)
+			session.Close()
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			logger.Warn("Upstream POST failed", "status", resp.Status)
+			p.metrics.upstreamFailure(up.config.Name, resp)
+		}
+		session.Close()
+	}()
+
+	if up.usePollDownload(p.config.DownloadMode) {
+		download, downloadWriter := io.Pipe()
+		go func() {
+			setHeaders := func(req *http.Request) { up.setMuxHeaders(req, sessionID) }
+			err := p.pollDownload(ctx, up, downloadWriter, setHeaders)
+			if err != nil {
+				p.metrics.upstreamError(up.config.Name, err)
+			}
+			downloadWriter.CloseWithError(err)
+		}()
+		go p.runMuxDownload(session, download)
+		logger.Info("Upstream mux session polling")
+		return session, nil
+	}
+
+	getReq, err := http.NewRequestWithContext(ctx, "GET", up.config.URLGET, nil)
+	if err != nil {
+		return fail(err)
+	}
+	up.setMuxHeaders(getReq, sessionID)
+
+	resp, err := up.httpClientGET.Do(getReq)
+	if err != nil {
+		return fail(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fail(fmt.Errorf("GET: %w", errUpstreamStatus(resp)))
+	}
+	up.learnCapabilities(resp.Header)
+	go p.runMuxDownload(session, resp.Body)
+	logger.Info("Upstream mux session established")
+	return session, nil
+}
+
+func (p *Proxy) runMuxDownload(session *muxSession, body io.ReadCloser) {
+	defer body.Close()
+	err := session.readLoop(body)
+	logger := slog.With("protocol", protocolMux, "mux_session", session.id)
+	if err != nil && err != io.EOF {
+		logger.Log(context.Background(), errorLevel(err), "Session error", "error", err)
+	}
+	logger.Info("Upstream mux session closed")
+}
+
+func (up *upstream) setMuxHeaders(req *http.Request, sessionID string) {
+	up.setTunnelHeaders(req, "", "", sessionID)
+	req.Header.Set("X-Mux", muxVersion)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// frameRecorder is a mux session writer that keeps every frame written.
+type frameRecorder struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+type recordedFrame struct {
+	frameType byte
+	streamID  uint32
+	payload   []byte
+}
+
+func (r *frameRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(b)
+}
+
+func (r *frameRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *frameRecorder) frames(t *testing.T) []recordedFrame {
+	t.Helper()
+	r.mu.Lock()
+	data := bytes.Clone(r.buf.Bytes())
+	r.mu.Unlock()
+
+	var frames []recordedFrame
+	for len(data) > 0 {
+		if len(data) < muxHeaderSize {
+			t.Fatalf("truncated frame header: % x", data)
+		}
+		length := int(binary.BigEndian.Uint32(data[5:9]))
+		if len(data) < muxHeaderSize+length {
+			t.Fatalf("truncated frame payload: want %d bytes, have %d", length, len(data)-muxHeaderSize)
+		}
+		frames = append(frames, recordedFrame{
+			frameType: data[0],
+			streamID:  binary.BigEndian.Uint32(data[1:5]),
+			payload:   data[muxHeaderSize : muxHeaderSize+length],
+		})
+		data = data[muxHeaderSize+length:]
+	}
+	return frames
+}
+
+// dataBytes sums the DATA payloads recorded so far.
+func (r *frameRecorder) dataBytes(t *testing.T) int {
+	n := 0
+	for _, f := range r.frames(t) {
+		if f.frameType == muxFrameData {
+			n += len(f.payload)
+		}
+	}
+	return n
+}
+
+func muxFrame(frameType byte, streamID uint32, payload string) []byte {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], streamID)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMuxWriteFrame(t *testing.T) {
+	tests := []struct {
+		name      string
+		frameType byte
+		streamID  uint32
+		payload   []byte
+		want      []byte
+	}{
+		{
+			name:      "open",
+			frameType: muxFrameOpen,
+			streamID:  1,
+			payload:   []byte("example.com:443"),
+			want:      append([]byte{0x01, 0, 0, 0, 1, 0, 0, 0, 15}, "example.com:443"...),
+		},
+		{
+			name:      "data",
+			frameType: muxFrameData,
+			streamID:  0x01020304,
+			payload:   []byte{0xff, 0x00},
+			want:      []byte{0x02, 1, 2, 3, 4, 0, 0, 0, 2, 0xff, 0x00},
+		},
+		{
+			name:      "close without reason",
+			frameType: muxFrameClose,
+			streamID:  7,
+			want:      []byte{0x03, 0, 0, 0, 7, 0, 0, 0, 0},
+		},
+		{
+			name:      "window",
+			frameType: muxFrameWindow,
+			streamID:  2,
+			payload:   []byte{0, 2, 0, 0},
+			want:      []byte{0x04, 0, 0, 0, 2, 0, 0, 0, 4, 0, 2, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &frameRecorder{}
+			s := newMuxSession("test", rec, nil)
+			if err := s.writeFrame(tt.frameType, tt.streamID, tt.payload); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+			if got := rec.buf.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Errorf("frame = % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMuxWriteFrameAfterClose(t *testing.T) {
+	rec := &frameRecorder{}
+	s := newMuxSession("test", rec, nil)
+	s.Close()
+	if err := s.writeFrame(muxFrameData, 1, []byte("x")); !errors.Is(err, errMuxSessionClosed) {
+		t.Errorf("writeFrame after Close = %v, want %v", err, errMuxSessionClosed)
+	}
+	if !rec.closed {
+		t.Error("Close did not close the session writer")
+	}
+}
+
+func TestMuxReadLoop(t *testing.T) {
+	tooLarge := make([]byte, muxHeaderSize)
+	tooLarge[0] = muxFrameData
+	binary.BigEndian.PutUint32(tooLarge[5:9], muxMaxPayload+1)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		server  bool
+		wantErr string
+	}{
+		{name: "empty", wantErr: "EOF"},
+		{name: "truncated header", input: []byte{muxFrameData, 0, 0}, wantErr: "unexpected EOF"},
+		{name: "truncated payload", input: muxFrame(muxFrameData, 1, "hello")[:muxHeaderSize+2], wantErr: "unexpected EOF"},
+		{name: "payload too large", input: tooLarge, wantErr: "mux frame too large: 65537"},
+		{name: "unknown frame type", input: muxFrame(0x09, 1, ""), wantErr: "unknown mux frame type: 9"},
+		{name: "open on client", input: muxFrame(muxFrameOpen, 1, "example.com:443"), wantErr: "unexpected mux OPEN frame"},
+		{name: "open on server", input: muxFrame(muxFrameOpen, 1, "example.com:443"), server: true, wantErr: "EOF"},
+		{name: "duplicate open", input: bytes.Join([][]byte{
+			muxFrame(muxFrameOpen, 1, "example.com:443"),
+			muxFrame(muxFrameOpen, 1, "example.net:443"),
+		}, nil), server: true, wantErr: "duplicate mux stream ID: 1"},
+		{name: "data within the window", input: bytes.Join([][]byte{
+			muxFrame(muxFrameOpen, 1, "example.com:443"),
+			bytes.Repeat(muxFrame(muxFrameData, 1, strings.Repeat("x", muxMaxPayload)), muxInitialWindow/muxMaxPayload),
+		}, nil), server: true, wantErr: "EOF"},
+		{name: "data past the window", input: bytes.Join([][]byte{
+			muxFrame(muxFrameOpen, 1, "example.com:443"),
+			bytes.Repeat(muxFrame(muxFrameData, 1, strings.Repeat("x", muxMaxPayload)), muxInitialWindow/muxMaxPayload),
+			muxFrame(muxFrameData, 1, "x"),
+		}, nil), server: true, wantErr: "mux stream 1 exceeded its receive window"},
+		{name: "frames for unknown streams", input: bytes.Join([][]byte{
+			muxFrame(muxFrameData, 5, "data"),
+			muxFrame(muxFrameWindow, 5, "\x00\x00\x01\x00"),
+			muxFrame(muxFrameClose, 5, "reason"),
+		}, nil), wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var onOpen func(*muxStream, string)
+			if tt.server {
+				onOpen = func(*muxStream, string) {}
+			}
+			s := newMuxSession("test", &frameRecorder{}, onOpen)
+			err := s.readLoop(bytes.NewReader(tt.input))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("readLoop = %v, want %q", err, tt.wantErr)
+			}
+			if !s.isClosed() {
+				t.Error("readLoop did not close the session")
+			}
+		})
+	}
+}
+
+func TestMuxRoundTrip(t *testing.T) {
+	upR, upW := io.Pipe()
+	downR, downW := io.Pipe()
+
+	type opened struct {
+		stream *muxStream
+		target string
+	}
+	openCh := make(chan opened, 1)
+	server := newMuxSession("test", downW, func(stream *muxStream, target string) {
+		openCh <- opened{stream, target}
+	})
+	client := newMuxSession("test", upW, nil)
+	go server.readLoop(upR)
+	go client.readLoop(downR)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open("example.com:443")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	var remote opened
+	select {
+	case remote = <-openCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server never saw the OPEN frame")
+	}
+	if remote.target != "example.com:443" {
+		t.Errorf("target = %q, want %q", remote.target, "example.com:443")
+	}
+
+	// More than the initial window, so the reader must grant credit for the
+	// writer to finish.
+	want := bytes.Repeat([]byte("0123456789abcdef"), 2*muxInitialWindow/16)
+	go func() {
+		stream.Write(want)
+		stream.CloseWithReason("done")
+	}()
+	got, err := io.ReadAll(remote.stream)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("received %d bytes, want %d matching bytes", len(got), len(want))
+	}
+	if reason := remote.stream.closeReason(); reason != "done" {
+		t.Errorf("close reason = %q, want %q", reason, "done")
+	}
+}
+
+func TestMuxStreamSendWindow(t *testing.T) {
+	rec := &frameRecorder{}
+	s := newMuxSession("test", rec, nil)
+	stream, err := s.Open("example.com:443")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	const extra = 100
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, muxInitialWindow+extra))
+		done <- err
+	}()
+
+	waitFor(t, func() bool { return rec.dataBytes(t) == muxInitialWindow })
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned (%v) before the peer granted more window", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	stream.grant(extra)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write still blocked after the window grant")
+	}
+	if n := rec.dataBytes(t); n != muxInitialWindow+extra {
+		t.Errorf("sent %d data bytes, want %d", n, muxInitialWindow+extra)
+	}
+	for _, f := range rec.frames(t) {
+		if len(f.payload) > muxMaxPayload {
+			t.Errorf("frame payload of %d bytes exceeds %d", len(f.payload), muxMaxPayload)
+		}
+	}
+}
+
+func TestMuxStreamWindowUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		received    []int // sizes of DATA payloads, each read fully before the next
+		wantUpdates []uint32
+	}{
+		{name: "below threshold", received: []int{muxWindowUpdateAt - 1}},
+		{name: "at threshold", received: []int{muxWindowUpdateAt}, wantUpdates: []uint32{muxWindowUpdateAt}},
+		{name: "accumulated", received: []int{muxWindowUpdateAt - 1, 2}, wantUpdates: []uint32{muxWindowUpdateAt + 1}},
+		{name: "twice", received: []int{muxWindowUpdateAt, 10, muxWindowUpdateAt}, wantUpdates: []uint32{muxWindowUpdateAt, muxWindowUpdateAt + 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &frameRecorder{}
+			s := newMuxSession("test", rec, nil)
+			stream := s.newStream(1)
+			buf := make([]byte, muxInitialWindow)
+			for _, n := range tt.received {
+				if err := stream.receive(make([]byte, n)); err != nil {
+					t.Fatalf("receive: %v", err)
+				}
+				if got, err := stream.Read(buf); err != nil || got != n {
+					t.Fatalf("Read = %d, %v; want %d, nil", got, err, n)
+				}
+			}
+
+			var updates []uint32
+			for _, f := range rec.frames(t) {
+				if f.frameType == muxFrameWindow && f.streamID == 1 {
+					updates = append(updates, binary.BigEndian.Uint32(f.payload))
+				}
+			}
+			if len(updates) != len(tt.wantUpdates) {
+				t.Fatalf("window updates = %v, want %v", updates, tt.wantUpdates)
+			}
+			for i := range updates {
+				if updates[i] != tt.wantUpdates[i] {
+					t.Errorf("window updates = %v, want %v", updates, tt.wantUpdates)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestMuxStreamClose(t *testing.T) {
+	rec := &frameRecorder{}
+	s := newMuxSession("test", rec, nil)
+	stream := s.newStream(1)
+
+	stream.receive([]byte("buffered"))
+	stream.closeRemote("target closed")
+	if err := stream.receive([]byte("late")); err != nil {
+		t.Errorf("receive after close = %v, want nil", err)
+	}
+
+	// Data received before the CLOSE is still delivered, then EOF.
+	got, err := io.ReadAll(stream)
+	if err != nil || string(got) != "buffered" {
+		t.Errorf("ReadAll = %q, %v; want %q, nil", got, err, "buffered")
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("Write after close = %v, want %v", err, io.ErrClosedPipe)
+	}
+	if s.stream(1) != nil {
+		t.Error("closed stream still registered with the session")
+	}
+	if len(rec.frames(t)) != 0 {
+		t.Error("remote close echoed a frame to the peer")
+	}
+
+	local := s.newStream(2)
+	local.Close()
+	local.Close()
+	frames := rec.frames(t)
+	if len(frames) != 1 || frames[0].frameType != muxFrameClose || frames[0].streamID != 2 {
+		t.Errorf("local close sent %+v, want a single CLOSE for stream 2", frames)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ============================================================================
+// PAC File
+// ============================================================================
+//
+// GET /proxy.pac on the listen address returns a proxy auto-config script
+// generated from the routing rules, in the same order and with the same
+// first-match semantics. Targets routed direct get DIRECT; everything else,
+// blocked targets included, goes to the proxy, which applies the rules again.
+// Like the proxy, the script never resolves hostnames: domain matchers only
+// match hostnames and cidr only matches IP literals.
+
+const (
+	pacPath        = "/proxy.pac"
+	pacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// pacHelpers are the functions the generated conditions call.
+const pacHelpers = `function isIPv4(h) { return /^\d+\.\d+\.\d+\.\d+$/.test(h); }
+function suffix(h, s) { return h === s || h.slice(-s.length - 1) === "." + s; }
+function inSet(h, set) {
+  for (;;) {
+    if (Object.prototype.hasOwnProperty.call(set, h)) return true;
+    var i = h.indexOf(".");
+    if (i < 0) return false;
+    h = h.slice(i + 1);
+  }
+}
+function re(s, h) { try { return new RegExp(s).test(h); } catch (e) { return false; } }
+function portOf(url) {
+  var m = /^([a-z][a-z0-9+.-]*):\/\/(?:[^\/@]*@)?(?:\[[^\]]*\]|[^\/:]*)(?::(\d+))?/i.exec(url);
+  if (m && m[2]) return parseInt(m[2], 10);
+  return m && m[1].toLowerCase() === "https" ? 443 : 80;
+}
+`
+
+func (p *Proxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Serving PAC file", "client", r.RemoteAddr)
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, p.generatePAC(p.pacProxyAddr(r)))
+}
+
+// pacProxyAddr is the listen address, or, when it is a wildcard, the host the
+// client used to fetch the PAC file with the listen port.
+func (p *Proxy) pacProxyAddr(r *http.Request) string {
+	host, port, _ := net.SplitHostPort(p.config.ListenAddr)
+	if addr, err := netip.ParseAddr(host); host == "" || err == nil && addr.IsUnspecified() {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func (p *Proxy) generatePAC(proxyAddr string) string {
+	var b, sets strings.Builder
+	fmt.Fprintf(&b, "function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "  host = host.toLowerCase().replace(/^\\[|\\]$/g, \"\").replace(/\\.$/, \"\");\n")
+	fmt.Fprintf(&b, "  var ip4 = isIPv4(host), ip = ip4 || host.indexOf(\":\") >= 0, port = portOf(url);\n")
+
+	for i, r := range p.config.Rules {
+		fmt.Fprintf(&b, "  // %s\n", strings.ReplaceAll(r.spec, "\n", " "))
+		terms := pacTerms(r.entries, fmt.Sprintf("set%d", i), &sets)
+		// IPv6 literals the rule might match go to the proxy, which applies
+		// the rule itself, rather than on to the rules below.
+		ipv6 := hasIPv6CIDR(r.entries)
+		if ipv6 && r.route.action != routeDirect {
+			terms, ipv6 = append(terms, pacIPv6Term), false
+		}
+		if len(terms) > 0 {
+			fmt.Fprintf(&b, "  if (%s) return %s;\n", strings.Join(terms, " || "), pacResult(r.route))
+		}
+		if ipv6 {
+			fmt.Fprintf(&b, "  if (%s) return proxy;\n", pacIPv6Term)
+		}
+	}
+	fmt.Fprintf(&b, "  return %s;\n}\n", pacResult(p.config.DefaultRoute))
+
+	return fmt.Sprintf("// Generated by TwoPass Client %s from its routing rules.\nvar proxy = %s;\n%s%s%s",
+		Version, jsString("PROXY "+proxyAddr), pacHelpers, sets.String(), b.String())
+}
+
+// pacIPv6Term matches any IPv6 literal. PAC has no portable IPv6 network
+// test, so it stands in for IPv6 CIDRs.
+const pacIPv6Term = "ip && !ip4"
+
+func hasIPv6CIDR(entries []ruleEntry) bool {
+	for _, e := range entries {
+		if e.kind != matchCIDR {
+			continue
+		}
+		if prefix, err := parsePrefix(e.value); err == nil && !prefix.Addr().Is4() {
+			return true
+		}
+	}
+	return false
+}
+
+// pacTerms returns one JavaScript condition per entry, leaving out IPv6
+// CIDRs. Domain suffixes of a
+// rule file are collected into an object named set, declared in sets.
+func pacTerms(entries []ruleEntry, set string, sets *strings.Builder) []string {
+	var terms []string
+	var suffixes []string
+	for _, e := range entries {
+		switch e.kind {
+		case matchDomainSuffix:
+			suffixes = append(suffixes, normalizeHost(e.value))
+		case matchDomainKeyword:
+			terms = append(terms, fmt.Sprintf("!ip && host.indexOf(%s) >= 0", jsString(strings.ToLower(e.value))))
+		case matchRegex:
+			terms = append(terms, fmt.Sprintf("!ip && re(%s, host)", jsString(e.value)))
+		case matchCIDR:
+			if prefix, err := parsePrefix(e.value); err == nil && prefix.Addr().Is4() {
+				mask := net.CIDRMask(prefix.Bits(), 32)
+				terms = append(terms, fmt.Sprintf("ip4 && isInNet(host, %s, %s)", jsString(prefix.Addr().String()), jsString(net.IP(mask).String())))
+			}
+		case matchPort:
+			low, high, _ := parsePortRange(e.value)
+			if low == high {
+				terms = append(terms, fmt.Sprintf("port === %d", low))
+			} else {
+				terms = append(terms, fmt.Sprintf("port >= %d && port <= %d", low, high))
+			}
+		}
+	}
+
+	switch {
+	case len(suffixes) == 1:
+		terms = append([]string{fmt.Sprintf("!ip && suffix(host, %s)", jsString(suffixes[0]))}, terms...)
+	case len(suffixes) > 1:
+		fmt.Fprintf(sets, "var %s = {", set)
+		for i, s := range suffixes {
+			if i > 0 {
+				sets.WriteString(",")
+			}
+			fmt.Fprintf(sets, "\n  %s: 1", jsString(s))
+		}
+		sets.WriteString("\n};\n")
+		terms = append([]string{fmt.Sprintf("!ip && inSet(host, %s)", set)}, terms...)
+	}
+	return terms
+}
+
+func pacResult(r route) string {
+	if r.action == routeDirect {
+		return `"DIRECT"`
+	}
+	return "proxy"
+}
+
+// jsString quotes s as a JavaScript string literal.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
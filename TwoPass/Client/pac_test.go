@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPACTerms(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []ruleEntry
+		want     []string
+		wantSets string
+	}{
+		{
+			name:    "domain suffix",
+			entries: []ruleEntry{{matchDomainSuffix, ".Example.COM."}},
+			want:    []string{`!ip && suffix(host, "example.com")`},
+		},
+		{
+			name:    "domain keyword",
+			entries: []ruleEntry{{matchDomainKeyword, "Ads"}},
+			want:    []string{`!ip && host.indexOf("ads") >= 0`},
+		},
+		{
+			name:    "regex is quoted",
+			entries: []ruleEntry{{matchRegex, `^api\d+\."x"$`}},
+			want:    []string{`!ip && re("^api\\d+\\.\"x\"$", host)`},
+		},
+		{
+			name:    "ipv4 cidr",
+			entries: []ruleEntry{{matchCIDR, "10.1.2.3/8"}},
+			want:    []string{`ip4 && isInNet(host, "10.0.0.0", "255.0.0.0")`},
+		},
+		{
+			name:    "single address",
+			entries: []ruleEntry{{matchCIDR, "192.0.2.1"}},
+			want:    []string{`ip4 && isInNet(host, "192.0.2.1", "255.255.255.255")`},
+		},
+		{
+			name:    "ipv6 cidr left out",
+			entries: []ruleEntry{{matchCIDR, "2001:db8::/32"}},
+		},
+		{
+			name:    "port",
+			entries: []ruleEntry{{matchPort, "25"}},
+			want:    []string{"port === 25"},
+		},
+		{
+			name:    "port range",
+			entries: []ruleEntry{{matchPort, "8000-9000"}},
+			want:    []string{"port >= 8000 && port <= 9000"},
+		},
+		{
+			name: "rule file",
+			entries: []ruleEntry{
+				{matchDomainSuffix, "a.example"},
+				{matchCIDR, "172.16.0.0/12"},
+				{matchDomainSuffix, "B.example"},
+				{matchCIDR, "2001:db8::/32"},
+			},
+			want: []string{
+				`!ip && inSet(host, set3)`,
+				`ip4 && isInNet(host, "172.16.0.0", "255.240.0.0")`,
+			},
+			wantSets: "var set3 = {\n  \"a.example\": 1,\n  \"b.example\": 1\n};\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sets strings.Builder
+			got := pacTerms(tt.entries, "set3", &sets)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("terms = %q, want %q", got, tt.want)
+			}
+			if sets.String() != tt.wantSets {
+				t.Errorf("sets = %q, want %q", sets.String(), tt.wantSets)
+			}
+		})
+	}
+}
+
+func TestGeneratePAC(t *testing.T) {
+	p := &Proxy{config: Config{
+		Rules: mustParseRules(t,
+			"domain-suffix,lan,direct",
+			"cidr,2001:db8::/32,direct",
+			"port,25,block",
+			"domain-keyword,cdn,tunnel:cf",
+		),
+		DefaultRoute: route{action: routeDirect},
+	}}
+	pac := p.generatePAC("127.0.0.1:8080")
+
+	// Rules appear in order, blocked and tunneled targets go to the proxy.
+	want := []string{
+		`var proxy = "PROXY 127.0.0.1:8080";`,
+		"function FindProxyForURL(url, host) {",
+		"  // domain-suffix,lan,direct",
+		`  if (!ip && suffix(host, "lan")) return "DIRECT";`,
+		"  // cidr,2001:db8::/32,direct",
+		"  if (ip && !ip4) return proxy;",
+		"  // port,25,block",
+		"  if (port === 25) return proxy;",
+		"  // domain-keyword,cdn,tunnel:cf",
+		`  if (!ip && host.indexOf("cdn") >= 0) return proxy;`,
+		`  return "DIRECT";`,
+	}
+	rest := pac
+	for _, line := range want {
+		i := strings.Index(rest, line+"\n")
+		if i < 0 {
+			t.Fatalf("PAC is missing %q after the previous lines:\n%s", line, pac)
+		}
+		rest = rest[i+len(line):]
+	}
+	for _, helper := range []string{"function isIPv4(", "function suffix(", "function inSet(", "function re(", "function portOf("} {
+		if !strings.Contains(pac, helper) {
+			t.Errorf("PAC is missing helper %s", helper)
+		}
+	}
+}
+
+// An IPv6 target must not fall through a rule that might match it.
+func TestGeneratePACIPv6CIDR(t *testing.T) {
+	rules := writeRuleFile(t, "10.0.0.0/8\n2001:db8::/32\n")
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{
+			name: "tunnel",
+			rule: "cidr,2001:db8::/32,tunnel",
+			want: "  if (ip && !ip4) return proxy;\n",
+		},
+		{
+			name: "direct rule file",
+			rule: "rule-file," + rules + ",direct",
+			want: "  if (ip4 && isInNet(host, \"10.0.0.0\", \"255.0.0.0\")) return \"DIRECT\";\n  if (ip && !ip4) return proxy;\n",
+		},
+		{
+			name: "block rule file",
+			rule: "rule-file," + rules + ",block",
+			want: "  if (ip4 && isInNet(host, \"10.0.0.0\", \"255.0.0.0\") || ip && !ip4) return proxy;\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Proxy{config: Config{
+				Rules:        mustParseRules(t, tt.rule),
+				DefaultRoute: route{action: routeDirect},
+			}}
+			pac := p.generatePAC("127.0.0.1:8080")
+			want := "  // " + tt.rule + "\n" + tt.want + "  return \"DIRECT\";\n"
+			if !strings.Contains(pac, want) {
+				t.Errorf("PAC does not contain\n%s\n%s", want, pac)
+			}
+		})
+	}
+}
+
+func TestGeneratePACDefaultTunnel(t *testing.T) {
+	p := &Proxy{config: Config{DefaultRoute: route{action: routeTunnel}}}
+	pac := p.generatePAC("[::1]:8080")
+	if !strings.Contains(pac, `var proxy = "PROXY [::1]:8080";`) {
+		t.Errorf("PAC does not declare the IPv6 proxy address:\n%s", pac)
+	}
+	if !strings.HasSuffix(pac, "  return proxy;\n}\n") {
+		t.Errorf("PAC does not end by returning the proxy:\n%s", pac)
+	}
+}
+
+func TestPACProxyAddr(t *testing.T) {
+	tests := []struct {
+		listen string
+		host   string
+		want   string
+	}{
+		{"127.0.0.1:8080", "example.com", "127.0.0.1:8080"},
+		{"[::1]:8080", "example.com", "[::1]:8080"},
+		{":8080", "proxy.lan:8080", "proxy.lan:8080"},
+		{":8080", "proxy.lan", "proxy.lan:8080"},
+		{"0.0.0.0:8080", "192.0.2.10:8080", "192.0.2.10:8080"},
+		{"[::]:8080", "[2001:db8::1]:8080", "[2001:db8::1]:8080"},
+	}
+	for _, tt := range tests {
+		p := &Proxy{config: Config{ListenAddr: tt.listen}}
+		r := httptest.NewRequest("GET", pacPath, nil)
+		r.Host = tt.host
+		if got := p.pacProxyAddr(r); got != tt.want {
+			t.Errorf("pacProxyAddr(listen %s, Host %s) = %s, want %s", tt.listen, tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Packet-Up Upload Mode
+// ============================================================================
+//
+// In packet mode the upload leg of V2 is split into many short POSTs, each
+// carrying the session ID and an X-Seq sequence number starting at 0. The
+// server reassembles them in order, so middleboxes that buffer request
+// bodies never hold back the stream.
+
+const (
+	uploadModeStream = "stream"
+	uploadModePacket = "packet"
+
+	seqHeader = "X-Seq"
+
+	// POSTs in flight per tunnel; the server reorders them by sequence number.
+	packetUploadConcurrency = 4
+
+	// Out-of-order packets the server buffers before rejecting the upload,
+	// and the largest single packet it accepts.
+	maxPendingPackets = 256
+	maxPacketSize     = 1024 * 1024
+
+	// Attempts per packet before the client gives up on the tunnel, and the
+	// wait before the first retry, doubled for each further one.
+	packetMaxAttempts  = 3
+	packetRetryBackoff = 250 * time.Millisecond
+)
+
+var errTooManyPendingPackets = errors.New("too many out-of-order packets")
+
+func (p *Proxy) handleV2PacketUpload(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort, sessionID, protocolV2 string, closeOnce *sync.Once, tunnelClose func()) {
+	setHeaders := func(req *http.Request) {
+		up.setTunnelHeaders(req, targetHost, targetPort, sessionID)
+	}
+	err := p.uploadPackets(ctx, up, clientConn, setHeaders)
+	if err != nil {
+		loggerFrom(ctx).Log(ctx, errorLevel(err), "Packet upload failed", "error", err)
+		up.reportFailure(err)
+		p.metrics.upstreamError(up.config.Name, err)
+	}
+	tunnelFrom(ctx).closing(upstreamErrorReason(err))
+	closeOnce.Do(tunnelClose)
+}
+
+// uploadPackets reads src until EOF and sends every read as one
+// sequence-numbered POST, keeping up to packetUploadConcurrency in flight.
+func (p *Proxy) uploadPackets(ctx context.Context, up *upstream, src io.Reader, setHeaders func(*http.Request)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	sem := make(chan struct{}, packetUploadConcurrency)
+	buf := make([]byte, p.config.PacketSize)
+	var seq uint64
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return firstErr
+			}
+			wg.Add(1)
+			go func(seq uint64, chunk []byte) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := up.sendPacket(ctx, seq, chunk, setHeaders); err != nil {
+					fail(err)
+				}
+			}(seq, bytes.Clone(buf[:n]))
+			seq++
+		}
+
+		if readErr != nil {
+			wg.Wait()
+			if firstErr != nil {
+				return firstErr
+			}
+			if readErr == io.EOF {
+				return nil
+			}
+			return readErr
+		}
+	}
+}
+
+// sendPacket posts one packet, retrying transport errors and 5xx responses.
+// The server drops packets it has already written, so retrying one whose
+// response was lost is harmless.
+func (up *upstream) sendPacket(ctx context.Context, seq uint64, chunk []byte, setHeaders func(*http.Request)) error {
+	backoff := packetRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := up.postPacket(ctx, seq, chunk, setHeaders)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		var statusErr *upstreamStatusError
+		isStatus := errors.As(err, &statusErr)
+		if attempt >= packetMaxAttempts || isStatus && statusErr.code < 500 {
+			if isStatus {
+				tunnelFrom(ctx).closing(closeUpstreamStatus)
+			}
+			return err
+		}
+		loggerFrom(ctx).Debug("Retrying packet", "seq", seq, "attempt", attempt, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (up *upstream) postPacket(ctx context.Context, seq uint64, chunk []byte, setHeaders func(*http.Request)) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", up.config.URLPOST, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(seqHeader, strconv.FormatUint(seq, 10))
+	setHeaders(req)
+
+	start := time.Now()
+	resp, err := up.httpClientPOST.Do(req)
+	if err != nil {
+		return err
+	}
+	up.metrics.observeLatency(up.httpVersionPOST, start)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	tunnelFrom(ctx).recordResponse("POST", up.httpVersionPOST, resp.StatusCode)
+
+	if resp.StatusCode != http.StatusCreated {
+		return errUpstreamStatus(resp)
+	}
+	return nil
+}
+
+// ============================================================================
+// Packet Reassembly (Server Side)
+// ============================================================================
+
+// packetAssembler writes sequence-numbered packets to w in order, buffering
+// packets that arrive early.
+type packetAssembler struct {
+	mu      sync.Mutex
+	w       io.Writer
+	next    uint64
+	pending map[uint64][]byte
+}
+
+func newPacketAssembler(w io.Writer) *packetAssembler {
+	return &packetAssembler{w: w, pending: make(map[uint64][]byte)}
+}
+
+func (a *packetAssembler) push(seq uint64, data []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if seq < a.next {
+		return nil // duplicate of a packet already written
+	}
+	if seq != a.next {
+		if len(a.pending) >= maxPendingPackets {
+			return errTooManyPendingPackets
+		}
+		a.pending[seq] = data
+		return nil
+	}
+
+	for {
+		if _, err := a.w.Write(data); err != nil {
+			return err
+		}
+		a.next++
+		next, ok := a.pending[a.next]
+		if !ok {
+			return nil
+		}
+		delete(a.pending, a.next)
+		data = next
+	}
+}
+
+// readPacket parses the X-Seq header and reads the (bounded) packet body.
+func readPacket(r *http.Request) (uint64, []byte, error) {
+	seq, err := strconv.ParseUint(r.Header.Get(seqHeader), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid sequence number: %s", r.Header.Get(seqHeader))
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPacketSize+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) > maxPacketSize {
+		return 0, nil, fmt.Errorf("packet exceeds %d bytes", maxPacketSize)
+	}
+	return seq, data, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSendPacketRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int // requests failed before the server accepts packets
+		failStatus   int // 0 drops the connection instead
+		wantErr      string
+		wantAttempts int32
+	}{
+		{name: "accepted", wantAttempts: 1},
+		{name: "transient 503", failures: 2, failStatus: http.StatusServiceUnavailable, wantAttempts: 3},
+		{name: "connection dropped", failures: 1, wantAttempts: 2},
+		{name: "persistent 502", failures: packetMaxAttempts, failStatus: http.StatusBadGateway, wantErr: "502", wantAttempts: packetMaxAttempts},
+		{name: "401 not retried", failures: 1, failStatus: http.StatusUnauthorized, wantErr: "401", wantAttempts: 1},
+		{name: "400 not retried", failures: 1, failStatus: http.StatusBadRequest, wantErr: "400", wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(seqHeader) != "7" {
+					t.Errorf("X-Seq = %q, want 7", r.Header.Get(seqHeader))
+				}
+				if attempts.Add(1) > int32(tt.failures) {
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				if tt.failStatus == 0 {
+					conn, _, _ := http.NewResponseController(w).Hijack()
+					conn.Close()
+					return
+				}
+				w.WriteHeader(tt.failStatus)
+			}))
+			defer ts.Close()
+
+			up := &upstream{
+				config:         UpstreamConfig{URLPOST: ts.URL},
+				httpClientPOST: ts.Client(),
+				metrics:        newMetrics(func() int { return 0 }),
+			}
+			err := up.sendPacket(context.Background(), 7, []byte("data"), func(*http.Request) {})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("sendPacket = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("sendPacket = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSendPacketStopsOnCancel(t *testing.T) {
+	var attempts atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	up := &upstream{
+		config:         UpstreamConfig{URLPOST: ts.URL},
+		httpClientPOST: ts.Client(),
+		metrics:        newMetrics(func() int { return 0 }),
+	}
+	if err := up.sendPacket(ctx, 0, []byte("data"), func(*http.Request) {}); err == nil {
+		t.Error("sendPacket succeeded after the tunnel was canceled")
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("%d attempts after cancel, want 1", got)
+	}
+}
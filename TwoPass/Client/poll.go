@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ============================================================================
+// Long-Poll Download Mode
+// ============================================================================
+//
+// In poll mode the download leg of V2 is a series of short GETs instead of
+// one streaming response. Each GET carries an X-Offset cursor: the number of
+// download bytes the client has received so far. The server drops everything
+// before the cursor and answers with whatever data is available within
+// pollWindow (possibly nothing), or 204 once the target has closed. A lost
+// response is simply requested again with the same cursor.
+
+const (
+	downloadModeStream = "stream"
+	downloadModePoll   = "poll"
+
+	offsetHeader = "X-Offset"
+
+	// How long the server holds a poll open waiting for target data.
+	pollWindow = 2 * time.Second
+
+	// Largest poll response, and the unacknowledged data the server buffers
+	// before it stops reading from the target.
+	maxPollResponse = 256 * 1024
+	maxPollBuffered = 1024 * 1024
+
+	// Consecutive failed polls before the client gives up on the tunnel.
+	pollMaxRetries = 3
+)
+
+var errInvalidOffset = errors.New("invalid download offset")
+
+func (p *Proxy) handleV2PollDownload(ctx context.Context, up *upstream, clientConn net.Conn, targetHost, targetPort, sessionID, protocolV2 string, connMutex *sync.Mutex, closeOnce *sync.Once, tunnelClose func()) {
+	setHeaders := func(req *http.Request) {
+		up.setTunnelHeaders(req, targetHost, targetPort, sessionID)
+	}
+
+	connMutex.Lock()
+	err := p.pollDownload(ctx, up, clientConn, setHeaders)
+	connMutex.Unlock()
+	if err != nil {
+		loggerFrom(ctx).Log(ctx, errorLevel(err), "Poll download failed", "error", err)
+		p.metrics.upstreamError(up.config.Name, err)
+	}
+	tunnelFrom(ctx).closing(upstreamErrorReason(err))
+	closeOnce.Do(tunnelClose)
+}
+
+// pollDownload issues successive GETs, writing each response body to dst,
+// until the server reports the end of the stream.
+func (p *Proxy) pollDownload(ctx context.Context, up *upstream, dst io.Writer, setHeaders func(*http.Request)) error {
+	var offset uint64
+	established := false
+	failures := 0
+
+	for {
+		data, done, err := up.poll(ctx, offset, setHeaders)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !established {
+				up.reportV2Failure()
+				return err
+			}
+			if failures++; failures >= pollMaxRetries {
+				return err
+			}
+			continue
+		}
+		failures = 0
+
+		if !established {
+			established = true
+			up.reportSuccess()
+			up.reportV2Success()
+			loggerFrom(ctx).Debug("Upstream poll download established")
+			tunnelFrom(ctx).established()
+		}
+
+		if len(data) > 0 {
+			if _, err := dst.Write(data); err != nil {
+				return err
+			}
+			offset += uint64(len(data))
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// poll fetches the download data at offset; done reports the end of the stream.
+func (up *upstream) poll(ctx context.Context, offset uint64, setHeaders func(*http.Request)) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", up.config.URLGET, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set(offsetHeader, strconv.FormatUint(offset, 10))
+	setHeaders(req)
+
+	resp, err := up.httpClientGET.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	up.learnCapabilities(resp.Header)
+	tunnel := tunnelFrom(ctx)
+	tunnel.recordResponse("GET", up.httpVersionGET, resp.StatusCode)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxPollResponse+1))
+		if err != nil {
+			return nil, false, err
+		}
+		if len(data) > maxPollResponse {
+			return nil, false, fmt.Errorf("poll response exceeds %d bytes", maxPollResponse)
+		}
+		return data, false, nil
+	case http.StatusNoContent:
+		return nil, true, nil
+	default:
+		tunnel.closing(closeUpstreamStatus)
+		return nil, false, errUpstreamStatus(resp)
+	}
+}
+
+// ============================================================================
+// Poll Buffer (Server Side)
+// ============================================================================
+
+// pollBuffer reads a download stream in the background and holds it until
+// the client acknowledges it with a later offset.
+type pollBuffer struct {
+	mu      sync.Mutex
+	base    uint64 // stream offset of data[0]
+	data    []byte
+	err     error // set once the source is exhausted
+	changed chan struct{}
+
+	// closed stops fill when the session ends, as nothing drains the
+	// buffer after that.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollBuffer(src io.Reader) *pollBuffer {
+	b := &pollBuffer{changed: make(chan struct{}), closed: make(chan struct{})}
+	go b.fill(src)
+	return b
+}
+
+// notify wakes everyone waiting on the buffer. Callers hold b.mu.
+func (b *pollBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *pollBuffer) close() {
+	b.closeOnce.Do(func() { close(b.closed) })
+}
+
+func (b *pollBuffer) fill(src io.Reader) {
+	buf := make([]byte, bufferSize)
+	for {
+		b.mu.Lock()
+		for len(b.data) >= maxPollBuffered {
+			changed := b.changed
+			b.mu.Unlock()
+			select {
+			case <-changed:
+			case <-b.closed:
+				b.mu.Lock()
+				b.err = net.ErrClosed
+				b.notify()
+				b.mu.Unlock()
+				return
+			}
+			b.mu.Lock()
+		}
+		b.mu.Unlock()
+
+		n, err := src.Read(buf)
+
+		b.mu.Lock()
+		b.data = append(b.data, buf[:n]...)
+		if err != nil {
+			b.err = err
+		}
+		b.notify()
+		b.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// poll acknowledges everything before offset and waits up to window for data
+// after it. It returns io.EOF (or the read error) once the stream is drained.
+func (b *pollBuffer) poll(ctx context.Context, offset uint64, window time.Duration) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if offset < b.base || offset > b.base+uint64(len(b.data)) {
+		return nil, errInvalidOffset
+	}
+	if acked := int(offset - b.base); acked > 0 {
+		b.data = b.data[acked:]
+		b.base = offset
+		b.notify()
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(b.data) == 0 && b.err == nil {
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			b.mu.Lock()
+			return nil, nil
+		case <-ctx.Done():
+			b.mu.Lock()
+			return nil, ctx.Err()
+		}
+		b.mu.Lock()
+	}
+
+	if len(b.data) == 0 {
+		return nil, b.err
+	}
+	n := min(len(b.data), maxPollResponse)
+	return append([]byte(nil), b.data[:n]...), nil
+}
+
+// writePoll answers one poll request from b.
+// It reports whether the download stream has ended.
+func writePoll(w http.ResponseWriter, r *http.Request, b *pollBuffer, protocol, sessionID string) bool {
+	offset, err := strconv.ParseUint(r.Header.Get(offsetHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return false
+	}
+
+	data, err := b.poll(r.Context(), offset, pollWindow)
+	if errors.Is(err, errInvalidOffset) {
+		slog.Warn("Poll rejected", "protocol", protocol, "session", sessionID, "offset", offset, "error", err)
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return false
+	}
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	setTunnelResponseHeaders(w)
+	if err != nil {
+		if err != io.EOF {
+			slog.Log(r.Context(), errorLevel(err), "Download error", "protocol", protocol, "session", sessionID, "error", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return false
+}
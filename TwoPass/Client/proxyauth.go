@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ============================================================================
+// Client Access Control
+// ============================================================================
+//
+// -allow limits which client addresses may use the proxy listeners.
+// -proxy-users makes HTTP clients authenticate with Basic Proxy-Authorization,
+// and SOCKS5 clients with username/password, against a users file, one
+// "user:password[:upstream]" per line:
+//
+//	alice:$2y$10$Fh6C0mJ3...:cf
+//	bob:correct-horse-battery
+//
+// Passwords are plain text or bcrypt hashes (htpasswd -B). A user with an
+// upstream has their tunnels sent through it unless a routing rule names
+// another one. The PAC file is served without credentials.
+
+const proxyAuthRealm = `Basic realm="TwoPass"`
+
+type proxyUser struct {
+	name     string
+	password string // plain text or a bcrypt hash
+	upstream string
+}
+
+type proxyUsers struct {
+	users map[string]proxyUser
+
+	// verified caches bcrypt checks that succeeded, keyed by a hash of the
+	// credentials, so that only the first request of a user pays for bcrypt.
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// loadProxyUsers reads a users file. Blank lines and lines starting with #
+// are skipped; passwords cannot contain a colon.
+func loadProxyUsers(path string) (*proxyUsers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy users file: %w", err)
+	}
+
+	u := &proxyUsers{users: make(map[string]proxyUser), verified: make(map[[sha256.Size]byte]bool)}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: want user:password[:upstream]", path, n+1)
+		}
+		user := proxyUser{name: fields[0], password: fields[1]}
+		if len(fields) == 3 {
+			user.upstream = fields[2]
+		}
+		if _, dup := u.users[user.name]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", path, n+1, user.name)
+		}
+		u.users[user.name] = user
+	}
+	if len(u.users) == 0 {
+		return nil, fmt.Errorf("proxy users file %s has no users", path)
+	}
+	return u, nil
+}
+
+func (u *proxyUsers) check(name, password string) (proxyUser, bool) {
+	user, ok := u.users[name]
+	if !ok {
+		return proxyUser{}, false
+	}
+	if !isBcryptHash(user.password) {
+		return user, subtle.ConstantTimeCompare([]byte(password), []byte(user.password)) == 1
+	}
+
+	key := sha256.Sum256([]byte(name + "\x00" + password))
+	u.mu.Lock()
+	hit := u.verified[key]
+	u.mu.Unlock()
+	if hit {
+		return user, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.password), []byte(password)) != nil {
+		return proxyUser{}, false
+	}
+	u.mu.Lock()
+	u.verified[key] = true
+	u.mu.Unlock()
+	return user, true
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// authorizeProxy checks the Proxy-Authorization header when -proxy-users is
+// set and answers 407 if it is missing or wrong. It returns the user, which is
+// empty without -proxy-users.
+func (p *Proxy) authorizeProxy(w http.ResponseWriter, r *http.Request) (proxyUser, bool) {
+	if p.config.ProxyUsers == nil {
+		return proxyUser{}, true
+	}
+	name, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+	if ok {
+		if user, valid := p.config.ProxyUsers.check(name, password); valid {
+			slog.Debug("Proxy client authenticated", "client", r.RemoteAddr, "user", name)
+			return user, true
+		}
+		slog.Warn("Proxy authentication failed", "client", r.RemoteAddr, "user", name)
+	} else {
+		slog.Debug("Proxy credentials missing", "client", r.RemoteAddr)
+	}
+	w.Header().Set("Proxy-Authenticate", proxyAuthRealm)
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+	return proxyUser{}, false
+}
+
+func parseProxyAuthorization(header string) (string, string, bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// clientAllowed reports whether -allow admits the client at remoteAddr.
+func (p *Proxy) clientAllowed(remoteAddr string) bool {
+	if len(p.config.AllowedClients) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range p.config.AllowedClients {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ============================================================================
+// Routing Rules
+// ============================================================================
+//
+// Every CONNECT, SOCKS5 and forwarded request is routed by the first -rule
+// that matches its target, or by -default-route when none does. A rule is
+// "matcher,value,action":
+//
+//	domain-suffix,lan,direct
+//	domain-keyword,doubleclick,block
+//	regex,^api[0-9]+\.example\.com$,tunnel:cf
+//	cidr,10.0.0.0/8,direct
+//	port,25,block
+//	rule-file,/etc/twopass/cn.txt,direct
+//
+// Domain matchers only see hostnames and cidr only sees IP literals; the
+// target is not resolved. The action is tunnel (through the selection policy),
+// tunnel:<upstream>, direct or block.
+
+const (
+	protocolDirect = "direct"
+
+	routeTunnel = "tunnel"
+	routeDirect = "direct"
+	routeBlock  = "block"
+
+	matchDomainSuffix  = "domain-suffix"
+	matchDomainKeyword = "domain-keyword"
+	matchRegex         = "regex"
+	matchCIDR          = "cidr"
+	matchPort          = "port"
+	matchRuleFile      = "rule-file"
+)
+
+var errBlockedByRule = errors.New("blocked by routing rule")
+
+// route is the action of a rule. It is a flag.Value for -default-route.
+type route struct {
+	action   string
+	upstream string // tunnel only; empty means the selection policy
+}
+
+func (r *route) String() string {
+	if r.upstream != "" {
+		return r.action + ":" + r.upstream
+	}
+	return r.action
+}
+
+func (r *route) Set(value string) error {
+	action, upstream, _ := strings.Cut(value, ":")
+	switch {
+	case action == routeTunnel:
+	case (action == routeDirect || action == routeBlock) && upstream == "":
+	default:
+		return fmt.Errorf("invalid route %q (want tunnel, tunnel:<upstream>, direct or block)", value)
+	}
+	*r = route{action: action, upstream: upstream}
+	return nil
+}
+
+// ruleTarget is the part of a target the matchers look at.
+type ruleTarget struct {
+	host string     // lower case, without brackets or trailing dot
+	addr netip.Addr // valid when host is an IP literal
+	port int
+}
+
+type ruleMatcher func(ruleTarget) bool
+
+// ruleEntry is one matcher and value, kept for generating the PAC file.
+type ruleEntry struct {
+	kind, value string
+}
+
+type rule struct {
+	spec    string      // as given, for logging
+	entries []ruleEntry // one per line of a rule file
+	match   ruleMatcher
+	route   route
+}
+
+// ruleList collects repeated -rule flags in order.
+type ruleList []rule
+
+func (l *ruleList) String() string {
+	specs := make([]string, len(*l))
+	for i, r := range *l {
+		specs[i] = r.spec
+	}
+	return strings.Join(specs, " ")
+}
+
+func (l *ruleList) Set(value string) error {
+	r, err := parseRule(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// parseRule splits a rule at its first and last comma, so regex values may
+// contain commas.
+func parseRule(spec string) (rule, error) {
+	kind, rest, ok := strings.Cut(strings.TrimSpace(spec), ",")
+	i := strings.LastIndex(rest, ",")
+	if !ok || i < 0 {
+		return rule{}, fmt.Errorf("invalid rule %q (want matcher,value,action)", spec)
+	}
+	r := rule{spec: spec}
+	if err := r.route.Set(strings.TrimSpace(rest[i+1:])); err != nil {
+		return rule{}, fmt.Errorf("rule %q: %w", spec, err)
+	}
+
+	var err error
+	if value := strings.TrimSpace(rest[:i]); kind == matchRuleFile {
+		r.match, r.entries, err = loadRuleFile(value)
+	} else {
+		r.match, err = parseMatcher(kind, value)
+		r.entries = []ruleEntry{{kind, value}}
+	}
+	if err != nil {
+		return rule{}, fmt.Errorf("rule %q: %w", spec, err)
+	}
+	return r, nil
+}
+
+func parseMatcher(kind, value string) (ruleMatcher, error) {
+	if value == "" {
+		return nil, errors.New("empty value")
+	}
+	switch kind {
+	case matchDomainSuffix:
+		suffix := normalizeHost(value)
+		return func(t ruleTarget) bool {
+			return !t.addr.IsValid() && (t.host == suffix || strings.HasSuffix(t.host, "."+suffix))
+		}, nil
+	case matchDomainKeyword:
+		keyword := strings.ToLower(value)
+		return func(t ruleTarget) bool {
+			return !t.addr.IsValid() && strings.Contains(t.host, keyword)
+		}, nil
+	case matchRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(t ruleTarget) bool {
+			return !t.addr.IsValid() && re.MatchString(t.host)
+		}, nil
+	case matchCIDR:
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(t ruleTarget) bool {
+			return t.addr.IsValid() && prefix.Contains(t.addr)
+		}, nil
+	case matchPort:
+		low, high, err := parsePortRange(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(t ruleTarget) bool {
+			return t.port >= low && t.port <= high
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown matcher %q", kind)
+	}
+}
+
+// parsePrefix accepts a CIDR or a single address.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// parsePortRange accepts "443" or "8000-9000".
+func parsePortRange(value string) (int, int, error) {
+	lowText, highText, isRange := strings.Cut(value, "-")
+	if !isRange {
+		highText = lowText
+	}
+	low, err := strconv.Atoi(lowText)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", value)
+	}
+	high, err := strconv.Atoi(highText)
+	if err != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port %q", value)
+	}
+	return low, high, nil
+}
+
+// loadRuleFile reads a list of matchers sharing one action, one per line as
+// "matcher,value" or just a domain suffix, IP or CIDR. Blank lines and lines
+// starting with # are skipped. Domain suffixes go into a set, so long lists
+// cost one lookup per label of the target.
+func loadRuleFile(path string) (ruleMatcher, []ruleEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read rule file: %w", err)
+	}
+
+	suffixes := make(map[string]bool)
+	var matchers []ruleMatcher
+	var entries []ruleEntry
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, ok := strings.Cut(line, ",")
+		if !ok {
+			kind, value = matchDomainSuffix, line
+			if _, err := parsePrefix(line); err == nil {
+				kind = matchCIDR
+			}
+		}
+		kind, value = strings.TrimSpace(kind), strings.TrimSpace(value)
+		if kind == matchDomainSuffix && value != "" {
+			suffixes[normalizeHost(value)] = true
+			entries = append(entries, ruleEntry{kind, value})
+			continue
+		}
+		m, err := parseMatcher(kind, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %w", path, n+1, err)
+		}
+		matchers = append(matchers, m)
+		entries = append(entries, ruleEntry{kind, value})
+	}
+
+	return func(t ruleTarget) bool {
+		if !t.addr.IsValid() {
+			for domain := t.host; domain != ""; {
+				if suffixes[domain] {
+					return true
+				}
+				_, domain, _ = strings.Cut(domain, ".")
+			}
+		}
+		for _, m := range matchers {
+			if m(t) {
+				return true
+			}
+		}
+		return false
+	}, entries, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(host), "."), ".")
+}
+
+// validateRoutes checks that every upstream named by a route or a proxy user
+// exists.
+func validateRoutes(cfg *Config) error {
+	names := make(map[string]bool)
+	for _, up := range cfg.upstreamConfigs() {
+		names[up.Name] = true
+	}
+	for _, r := range cfg.Rules {
+		if r.route.upstream != "" && !names[r.route.upstream] {
+			return fmt.Errorf("rule %q: unknown upstream %s", r.spec, r.route.upstream)
+		}
+	}
+	if up := cfg.DefaultRoute.upstream; up != "" && !names[up] {
+		return fmt.Errorf("-default-route: unknown upstream %s", up)
+	}
+	if cfg.ProxyUsers != nil {
+		for _, user := range cfg.ProxyUsers.users {
+			if user.upstream != "" && !names[user.upstream] {
+				return fmt.Errorf("proxy user %s: unknown upstream %s", user.name, user.upstream)
+			}
+		}
+	}
+	return nil
+}
+
+// routeFor returns the route of the first rule matching target (host:port),
+// or the default route.
+func (p *Proxy) routeFor(target string) route {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return p.config.DefaultRoute
+	}
+	t := ruleTarget{host: normalizeHost(host)}
+	if addr, err := netip.ParseAddr(t.host); err == nil {
+		t.addr = addr.Unmap()
+	}
+	t.port, _ = strconv.Atoi(port)
+
+	for _, r := range p.config.Rules {
+		if r.match(t) {
+			slog.Debug("Rule matched", "target", target, "rule", r.spec, "route", r.route.String())
+			return r.route
+		}
+	}
+	if len(p.config.Rules) > 0 {
+		slog.Debug("No rule matched, using the default route", "target", target, "route", p.config.DefaultRoute.String())
+	}
+	return p.config.DefaultRoute
+}
+
+// upstreamFor returns the upstream a tunnel route names, or the one picked by
+// the selection policy (or the admin pin).
+func (p *Proxy) upstreamFor(r route) *upstream {
+	if r.upstream != "" {
+		if up := p.upstreams.lookup(r.upstream); up != nil {
+			return up
+		}
+	}
+	return p.upstreams.pick()
+}
+
+// ============================================================================
+// Direct Connections
+// ============================================================================
+
+// dialDirect connects to the target without going through an upstream.
+func (p *Proxy) dialDirect(ctx context.Context, targetHost, targetPort string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.config.ConnTimeout}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(strings.Trim(targetHost, "[]"), targetPort))
+}
+
+func (p *Proxy) handleConnectDirect(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Proxy request", "protocol", protocolDirect, "client", r.RemoteAddr, "target", r.Host)
+
+	targetHost, targetPort, err := parseAndFormatTarget(r.Host)
+	if err != nil {
+		slog.Warn("Invalid target host format", "protocol", protocolDirect, "target", r.Host)
+		http.Error(w, "Invalid target host format", http.StatusBadRequest)
+		return
+	}
+
+	targetConn, err := p.dialDirect(r.Context(), targetHost, targetPort)
+	if err != nil {
+		slog.Warn("Direct connection failed", "protocol", protocolDirect, "target", r.Host, "error", err)
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, err := hijackAndRespond(w, p.config.StreamTimeout)
+	if err != nil {
+		slog.Warn("Hijack failed", "protocol", protocolDirect, "error", err)
+		targetConn.Close()
+		return
+	}
+	defer clientConn.Close()
+
+	p.relayDirect(r.Context(), clientConn, targetConn, targetHost, targetPort)
+	slog.Debug("Connection closed", "protocol", protocolDirect, "target", r.Host)
+}
+
+// relayDirect relays between the client and an already dialed target. It is
+// tracked like any other tunnel.
+func (p *Proxy) relayDirect(ctx context.Context, clientConn, targetConn net.Conn, targetHost, targetPort string) {
+	ctx, clientConn, done := p.openTunnel(ctx, protocolDirect, generateSessionID(), "", clientConn, targetHost, targetPort)
+	defer done()
+	loggerFrom(ctx).Debug("Direct connection established")
+
+	stop := context.AfterFunc(ctx, func() { targetConn.Close() })
+	defer stop()
+	relay(clientConn, targetConn)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mustParseRules(t *testing.T, specs ...string) []rule {
+	t.Helper()
+	var rules ruleList
+	for _, spec := range specs {
+		if err := rules.Set(spec); err != nil {
+			t.Fatalf("parse rule %q: %v", spec, err)
+		}
+	}
+	return rules
+}
+
+func writeRuleFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		spec      string
+		wantRoute string
+		wantErr   string
+	}{
+		{spec: "domain-suffix,lan,direct", wantRoute: "direct"},
+		{spec: " domain-keyword,ads,block ", wantRoute: "block"},
+		{spec: "cidr,10.0.0.0/8,tunnel", wantRoute: "tunnel"},
+		{spec: "port,8000-9000,tunnel:cf", wantRoute: "tunnel:cf"},
+		{spec: "regex,^a{1,3}\\.example\\.com$,direct", wantRoute: "direct"},
+
+		{spec: "domain-suffix,lan", wantErr: "want matcher,value,action"},
+		{spec: "domain-suffix", wantErr: "want matcher,value,action"},
+		{spec: "domain-suffix,,direct", wantErr: "empty value"},
+		{spec: "host,example.com,direct", wantErr: `unknown matcher "host"`},
+		{spec: "domain-suffix,lan,direct:cf", wantErr: "invalid route"},
+		{spec: "domain-suffix,lan,proxy", wantErr: "invalid route"},
+		{spec: "regex,(,direct", wantErr: "missing closing )"},
+		{spec: "cidr,10.0.0.0/33,direct", wantErr: "netip.ParsePrefix"},
+		{spec: "port,0,block", wantErr: `invalid port "0"`},
+		{spec: "port,70000,block", wantErr: `invalid port "70000"`},
+		{spec: "port,9000-8000,block", wantErr: `invalid port "9000-8000"`},
+		{spec: "rule-file,/nonexistent/rules.txt,direct", wantErr: "read rule file"},
+	}
+	for _, tt := range tests {
+		r, err := parseRule(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseRule(%q) error = %v, want one containing %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := r.route.String(); got != tt.wantRoute {
+			t.Errorf("parseRule(%q) route = %s, want %s", tt.spec, got, tt.wantRoute)
+		}
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	ruleFile := writeRuleFile(t, `# comment
+
+example.org
+.Example.NET.
+192.168.0.0/16
+port,2222
+domain-keyword,tracker
+`)
+	p := &Proxy{config: Config{
+		Rules: mustParseRules(t,
+			"domain-suffix,lan,direct",
+			"domain-keyword,doubleclick,block",
+			"regex,^api[0-9]+\\.example\\.com$,tunnel:cf",
+			"cidr,10.0.0.0/8,direct",
+			"cidr,2001:db8::/32,direct",
+			"cidr,::ffff:172.16.0.0/108,block",
+			"cidr,203.0.113.7,block",
+			"port,25,block",
+			"port,6000-6010,direct",
+			"rule-file,"+ruleFile+",tunnel:file",
+		),
+		DefaultRoute: route{action: routeTunnel},
+	}}
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		// domain-suffix matches the name and its subdomains only.
+		{"lan:80", "direct"},
+		{"printer.LAN.:631", "direct"},
+		{"plan:80", "tunnel"},
+		{"lan.example.com:80", "tunnel"},
+
+		{"ad.doubleclick.net:443", "block"},
+		{"api12.example.com:443", "tunnel:cf"},
+		{"api.example.com:443", "tunnel"},
+
+		// cidr only matches IP literals, including mapped and bracketed ones.
+		{"10.1.2.3:443", "direct"},
+		{"[::ffff:10.1.2.3]:443", "direct"},
+		{"[2001:db8::1]:443", "direct"},
+		{"172.16.5.5:443", "block"},
+		{"172.32.0.1:443", "tunnel"},
+		{"203.0.113.7:443", "block"},
+		{"203.0.113.8:443", "tunnel"},
+		// Domain matchers never see IP literals.
+		{"10.0.0.1.lan:80", "direct"},
+
+		{"mail.example.com:25", "block"},
+		{"6005.example.com:6005", "direct"},
+		{"example.com:6011", "tunnel"},
+
+		// First match wins: port 25 blocks before the rule file tunnels.
+		{"example.org:25", "block"},
+		{"example.org:443", "tunnel:file"},
+		{"www.example.net:443", "tunnel:file"},
+		{"192.168.1.1:80", "tunnel:file"},
+		{"host:2222", "tunnel:file"},
+		{"tracker.example.com:443", "tunnel:file"},
+		{"notexample.org:443", "tunnel"},
+
+		{"no-port", "tunnel"},
+	}
+	for _, tt := range tests {
+		if got := p.routeFor(tt.target); got.String() != tt.want {
+			t.Errorf("routeFor(%q) = %s, want %s", tt.target, got.String(), tt.want)
+		}
+	}
+}
+
+func TestRouteForDefault(t *testing.T) {
+	p := &Proxy{config: Config{
+		Rules:        mustParseRules(t, "domain-suffix,lan,tunnel"),
+		DefaultRoute: route{action: routeDirect},
+	}}
+	if got := p.routeFor("example.com:443"); got.action != routeDirect {
+		t.Errorf("routeFor(unmatched) = %s, want the default route direct", got.String())
+	}
+}
+
+func TestLoadRuleFileErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		wantErr string
+	}{
+		{"example.com\nregex,(\n", "rules.txt:2: error parsing regexp"},
+		{"host,example.com", `rules.txt:1: unknown matcher "host"`},
+		{"\n\nport,x", `rules.txt:3: invalid port "x"`},
+		{"cidr,", "rules.txt:1: empty value"},
+	}
+	for _, tt := range tests {
+		_, _, err := loadRuleFile(writeRuleFile(t, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("loadRuleFile(%q) error = %v, want one containing %q", tt.content, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRouteSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    route
+		wantErr bool
+	}{
+		{value: "tunnel", want: route{action: routeTunnel}},
+		{value: "tunnel:cf", want: route{action: routeTunnel, upstream: "cf"}},
+		{value: "direct", want: route{action: routeDirect}},
+		{value: "block", want: route{action: routeBlock}},
+		{value: "block:cf", wantErr: true},
+		{value: "Tunnel", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		var r route
+		err := r.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && r != tt.want {
+			t.Errorf("Set(%q) = %+v, want %+v", tt.value, r, tt.want)
+		}
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ============================================================================
+// Server Types
+// ============================================================================
+
+// serverCapabilities is advertised in every authenticated response.
+const serverCapabilities = "1,2,mux,packet,poll"
+
+var validTargetHost = regexp.MustCompile(`^[\w\-.:\[\]]+$`)
+
+var errSessionClosed = errors.New("session closed")
+
+type ServerConfig struct {
+	// Listener Configuration
+	ListenAddr    string
+	ListenAddrTLS string
+	CertFile      string
+	KeyFile       string
+	EnableH3      bool
+
+	// Tunnel Configuration
+	AuthToken   string
+	AuthMode    string
+	AuthWindow  time.Duration
+	ConnTimeout time.Duration
+	SessionIdle time.Duration
+
+	// Logging
+	LogLevel  string
+	LogFormat string
+}
+
+// TunnelServer is the reference implementation of the TwoPass server side,
+// speaking the same wire protocol as the Cloudflare and Deno servers.
+type TunnelServer struct {
+	config   ServerConfig
+	auth     *authenticator
+	sessions *sessionTable
+	dialer   *net.Dialer
+
+	muxMu       sync.Mutex
+	muxSessions map[string]*serverMux
+}
+
+// tunnelSession is a V2 session: one target connection shared by the POST
+// (upload) and GET (download) requests carrying the same X-Session-ID.
+type tunnelSession struct {
+	id         string
+	once       sync.Once
+	conn       net.Conn
+	packets    *packetAssembler
+	pollOnce   sync.Once
+	poll       *pollBuffer
+	err        error
+	active     int
+	lastActive time.Time
+}
+
+// serverMux joins the upload and download halves of a mux session; frames
+// written by the session are read back out by the download request.
+type serverMux struct {
+	session *muxSession
+	frames  *io.PipeReader
+
+	// Packet-up uploads are reassembled into a pipe read by the session.
+	packetsOnce sync.Once
+	packets     *packetAssembler
+
+	// Long-poll downloads read the frame stream through a poll buffer.
+	pollOnce sync.Once
+	poll     *pollBuffer
+
+	// Requests in progress and when the last one ended, guarded by muxMu.
+	active     int
+	lastActive time.Time
+}
+
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*tunnelSession
+}
+
+// ============================================================================
+// Server Constructor and Listeners
+// ============================================================================
+
+func NewTunnelServer(cfg ServerConfig) *TunnelServer {
+	return &TunnelServer{
+		config:      cfg,
+		auth:        newAuthenticator(cfg.AuthToken, cfg.AuthMode, cfg.AuthWindow),
+		sessions:    &sessionTable{sessions: make(map[string]*tunnelSession)},
+		dialer:      &net.Dialer{Timeout: cfg.ConnTimeout},
+		muxSessions: make(map[string]*serverMux),
+	}
+}
+
+func (s *TunnelServer) Start() error {
+	go s.sessions.evictIdle(s.config.SessionIdle)
+	go s.evictIdleMux(s.config.SessionIdle)
+
+	errCh := make(chan error, 3)
+	if s.config.ListenAddr != "" {
+		go func() {
+			slog.Info("Listening for H2C connections", "addr", s.config.ListenAddr)
+			server := &http.Server{
+				Addr:    s.config.ListenAddr,
+				Handler: h2c.NewHandler(s, &http2.Server{}),
+			}
+			errCh <- server.ListenAndServe()
+		}()
+	}
+
+	if s.config.ListenAddrTLS != "" {
+		go func() {
+			slog.Info("Listening for H2 connections", "addr", s.config.ListenAddrTLS)
+			server := &http.Server{
+				Addr:      s.config.ListenAddrTLS,
+				Handler:   s,
+				TLSConfig: &tls.Config{NextProtos: []string{"h2", "http/1.1"}},
+			}
+			errCh <- server.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
+		}()
+
+		if s.config.EnableH3 {
+			go func() {
+				slog.Info("Listening for H3 connections", "addr", s.config.ListenAddrTLS+"/udp")
+				server := &http3.Server{
+					Addr:    s.config.ListenAddrTLS,
+					Handler: s,
+				}
+				errCh <- server.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
+			}()
+		}
+	}
+	return <-errCh
+}
+
+// ============================================================================
+// Request Handler
+// ============================================================================
+
+func (s *TunnelServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.auth.verify(r); err != nil {
+		slog.Warn("Unauthorized request", "client", r.RemoteAddr, "error", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set(capabilityHeader, serverCapabilities)
+
+	// Mux: many streams framed inside one session
+	if r.Header.Get("X-Mux") != "" {
+		s.handleMux(w, r)
+		return
+	}
+
+	targetHost := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Target-Host")))
+	if targetHost == "" || !validTargetHost.MatchString(targetHost) {
+		slog.Warn("Invalid target host", "client", r.RemoteAddr, "target_host", targetHost)
+		http.Error(w, "Invalid target host", http.StatusBadRequest)
+		return
+	}
+
+	targetPort, err := strconv.Atoi(r.Header.Get("X-Target-Port"))
+	if err != nil || targetPort < 1 || targetPort > 65535 {
+		slog.Warn("Invalid target port", "client", r.RemoteAddr, "target_port", r.Header.Get("X-Target-Port"))
+		http.Error(w, "Invalid target port", http.StatusBadRequest)
+		return
+	}
+	target := net.JoinHostPort(strings.Trim(targetHost, "[]"), strconv.Itoa(targetPort))
+
+	// V2: Decoupled streams (POST + GET)
+	if sessionID := r.Header.Get("X-Session-ID"); sessionID != "" {
+		s.handleSession(w, r, target, sessionID)
+		return
+	}
+
+	// V1: Single bidirectional stream
+	if r.Method == http.MethodPost {
+		s.handleV1(w, r, target)
+		return
+	}
+
+	slog.Warn("Method not allowed", "protocol", protocolV1, "client", r.RemoteAddr, "method", r.Method)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func (s *TunnelServer) handleV1(w http.ResponseWriter, r *http.Request, target string) {
+	logger := slog.With("protocol", protocolV1, "session", generateSessionID(), "target", target)
+	logger.Info("Proxy request", "client", r.RemoteAddr)
+
+	conn, err := s.dialer.DialContext(r.Context(), "tcp", target)
+	if err != nil {
+		logger.Warn("Connection failed", "error", err)
+		http.Error(w, "Connection failed", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	logger.Debug("Connected to target")
+
+	// HTTP/1.1 clients need full duplex to keep uploading while we respond.
+	http.NewResponseController(w).EnableFullDuplex()
+
+	go func() {
+		buf := make([]byte, bufferSize)
+		if _, err := io.CopyBuffer(conn, r.Body, buf); err != nil {
+			logger.Log(r.Context(), errorLevel(err), "Upload stream error", "error", err)
+		}
+	}()
+
+	setTunnelResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	buf := make([]byte, bufferSize)
+	if _, err := io.CopyBuffer(flushWriter{w}, conn, buf); err != nil {
+		logger.Log(r.Context(), errorLevel(err), "Download stream error", "error", err)
+	}
+	logger.Debug("Connection closed")
+}
+
+func (s *TunnelServer) handleSession(w http.ResponseWriter, r *http.Request, target, sessionID string) {
+	logger := slog.With("protocol", protocolV2, "session", sessionID, "target", target)
+	logger.Debug("Request for session", "method", r.Method)
+
+	session := s.sessions.acquire(sessionID)
+	defer s.sessions.release(session)
+
+	if err := session.connect(s.dialer, target); err != nil {
+		logger.Warn("Connection failed", "error", err)
+		s.sessions.remove(session)
+		http.Error(w, "Connection failed", http.StatusBadGateway)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if r.Header.Get(seqHeader) != "" {
+			s.handlePacket(w, r, session.packets, sessionID)
+			return
+		}
+
+		// POST: Upload (Client -> Target)
+		logger.Debug("Upload starting")
+		buf := make([]byte, bufferSize)
+		if _, err := io.CopyBuffer(session.conn, r.Body, buf); err != nil {
+			logger.Log(r.Context(), errorLevel(err), "Upload error", "error", err)
+			if !isExpectedError(err) {
+				http.Error(w, "Upload failed", http.StatusBadGateway)
+				return
+			}
+		}
+		setTunnelResponseHeaders(w)
+		w.WriteHeader(http.StatusCreated)
+
+	case http.MethodGet:
+		if r.Header.Get(offsetHeader) != "" {
+			session.pollOnce.Do(func() { session.poll = newPollBuffer(session.conn) })
+			if writePoll(w, r, session.poll, protocolV2, sessionID) {
+				s.sessions.remove(session)
+				logger.Debug("Connection closed")
+			}
+			return
+		}
+
+		// GET: Download (Target -> Client)
+		logger.Debug("Download starting")
+		setTunnelResponseHeaders(w)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		buf := make([]byte, bufferSize)
+		if _, err := io.CopyBuffer(flushWriter{w}, session.conn, buf); err != nil {
+			logger.Log(r.Context(), errorLevel(err), "Download error", "error", err)
+		}
+		s.sessions.remove(session)
+		logger.Debug("Connection closed")
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *TunnelServer) handleMux(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.Header.Get("X-Session-ID")
+
+	// V1: upload and download share one bidirectional POST
+	if sessionID == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sm := s.newServerMux(generateSessionID())
+		http.NewResponseController(w).EnableFullDuplex()
+		go s.serveMuxUpload(sm, r.Body)
+		s.serveMuxDownload(sm, w)
+		return
+	}
+
+	// V2: POST (upload) and GET (download) joined by session ID
+	sm := s.acquireMux(sessionID)
+	defer s.releaseMux(sm)
+	switch r.Method {
+	case http.MethodPost:
+		if r.Header.Get(seqHeader) != "" {
+			s.handlePacket(w, r, sm.packetAssembler(s), sessionID)
+			return
+		}
+		s.serveMuxUpload(sm, r.Body)
+		setTunnelResponseHeaders(w)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		if r.Header.Get(offsetHeader) != "" {
+			if writePoll(w, r, sm.pollBuffer(), protocolMux, sessionID) {
+				sm.session.Close()
+			}
+			return
+		}
+		s.serveMuxDownload(sm, w)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// packetAssembler starts the session's upload loop on first use.
+func (sm *serverMux) packetAssembler(s *TunnelServer) *packetAssembler {
+	sm.packetsOnce.Do(func() {
+		upload, uploadWriter := io.Pipe()
+		sm.packets = newPacketAssembler(uploadWriter)
+		go s.serveMuxUpload(sm, upload)
+		go func() {
+			<-sm.session.done
+			upload.Close()
+		}()
+	})
+	return sm.packets
+}
+
+// pollBuffer starts buffering the frame stream on first use.
+func (sm *serverMux) pollBuffer() *pollBuffer {
+	sm.pollOnce.Do(func() {
+		sm.poll = newPollBuffer(sm.frames)
+	})
+	return sm.poll
+}
+
+func (s *TunnelServer) newServerMux(sessionID string) *serverMux {
+	frames, framesWriter := io.Pipe()
+	sm := &serverMux{frames: frames}
+	sm.session = newMuxSession(sessionID, framesWriter, func(stream *muxStream, target string) {
+		s.serveMuxStream(sm.session, stream, target)
+	})
+	slog.Info("Mux session opened", "protocol", protocolMux, "session", sessionID)
+	return sm
+}
+
+func (s *TunnelServer) acquireMux(sessionID string) *serverMux {
+	s.muxMu.Lock()
+	defer s.muxMu.Unlock()
+	sm, ok := s.muxSessions[sessionID]
+	if !ok {
+		sm = s.newServerMux(sessionID)
+		s.muxSessions[sessionID] = sm
+		go func() {
+			<-sm.session.done
+			sm.pollOnce.Do(func() {})
+			if sm.poll != nil {
+				sm.poll.close()
+			}
+			s.muxMu.Lock()
+			if s.muxSessions[sessionID] == sm {
+				delete(s.muxSessions, sessionID)
+			}
+			s.muxMu.Unlock()
+		}()
+	}
+	sm.active++
+	sm.lastActive = time.Now()
+	return sm
+}
+
+func (s *TunnelServer) releaseMux(sm *serverMux) {
+	s.muxMu.Lock()
+	defer s.muxMu.Unlock()
+	sm.active--
+	sm.lastActive = time.Now()
+}
+
+// evictIdleMux closes V2 mux sessions that have had no active request for
+// longer than idle. A streaming POST or GET keeps its session active; with
+// packet uploads and long-poll downloads, the client going away only shows
+// as requests no longer arriving.
+func (s *TunnelServer) evictIdleMux(idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*serverMux
+		s.muxMu.Lock()
+		for id, sm := range s.muxSessions {
+			if sm.active == 0 && time.Since(sm.lastActive) > idle {
+				delete(s.muxSessions, id)
+				expired = append(expired, sm)
+			}
+		}
+		s.muxMu.Unlock()
+
+		for _, sm := range expired {
+			slog.Info("Session evicted", "protocol", protocolMux, "session", sm.session.id, "idle", idle)
+			sm.session.Close()
+		}
+	}
+}
+
+func (s *TunnelServer) serveMuxUpload(sm *serverMux, body io.Reader) {
+	logger := slog.With("protocol", protocolMux, "session", sm.session.id)
+	logger.Debug("Upload starting")
+	err := sm.session.readLoop(body)
+	if err != nil && err != io.EOF {
+		logger.Log(context.Background(), errorLevel(err), "Upload error", "error", err)
+	}
+	logger.Info("Mux session closed")
+}
+
+func (s *TunnelServer) serveMuxDownload(sm *serverMux, w http.ResponseWriter) {
+	logger := slog.With("protocol", protocolMux, "session", sm.session.id)
+	logger.Debug("Download starting")
+	setTunnelResponseHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	buf := make([]byte, bufferSize)
+	if _, err := io.CopyBuffer(flushWriter{w}, sm.frames, buf); err != nil {
+		logger.Log(context.Background(), errorLevel(err), "Download error", "error", err)
+	}
+	sm.session.Close()
+}
+
+func (s *TunnelServer) serveMuxStream(session *muxSession, stream *muxStream, target string) {
+	logger := slog.With("protocol", protocolMux, "session", session.id, "stream", stream.id, "target", target)
+	addr, err := validateMuxTarget(target)
+	if err != nil {
+		logger.Warn("Stream rejected", "error", err)
+		stream.CloseWithReason(err.Error())
+		return
+	}
+
+	conn, err := s.dialer.Dial("tcp", addr)
+	if err != nil {
+		logger.Warn("Stream connection failed", "error", err)
+		stream.CloseWithReason("connection failed")
+		return
+	}
+	defer conn.Close()
+	logger.Info("Stream connected")
+
+	relay(conn, stream)
+	logger.Debug("Stream closed")
+}
+
+// validateMuxTarget applies the header checks of ServeHTTP to a mux OPEN target.
+func validateMuxTarget(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	host = strings.ToLower(host)
+	if !validTargetHost.MatchString(host) {
+		return "", fmt.Errorf("invalid target host: %s", host)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 1 || portNum > 65535 {
+		return "", fmt.Errorf("invalid target port: %s", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// handlePacket accepts one packet-up upload and queues it for in-order delivery.
+func (s *TunnelServer) handlePacket(w http.ResponseWriter, r *http.Request, packets *packetAssembler, sessionID string) {
+	seq, data, err := readPacket(r)
+	if err != nil {
+		slog.Warn("Invalid packet", "protocol", protocolV2, "session", sessionID, "error", err)
+		http.Error(w, "Invalid packet", http.StatusBadRequest)
+		return
+	}
+	if err := packets.push(seq, data); err != nil {
+		slog.Warn("Packet rejected", "protocol", protocolV2, "session", sessionID, "seq", seq, "error", err)
+		http.Error(w, "Upload failed", http.StatusBadGateway)
+		return
+	}
+	setTunnelResponseHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func setTunnelResponseHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Cache-Control", "no-cache")
+}
+
+// ============================================================================
+// Session Table
+// ============================================================================
+
+// connect dials the target once per session; later requests reuse the result.
+func (ts *tunnelSession) connect(dialer *net.Dialer, target string) error {
+	ts.once.Do(func() {
+		ts.conn, ts.err = dialer.Dial("tcp", target)
+		if ts.err == nil {
+			ts.packets = newPacketAssembler(ts.conn)
+			slog.Info("Connected to target", "protocol", protocolV2, "session", ts.id, "target", target)
+		}
+	})
+	return ts.err
+}
+
+func (t *sessionTable) acquire(id string) *tunnelSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	session, ok := t.sessions[id]
+	if !ok {
+		session = &tunnelSession{id: id}
+		t.sessions[id] = session
+	}
+	session.active++
+	session.lastActive = time.Now()
+	return session
+}
+
+func (t *sessionTable) release(session *tunnelSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	session.active--
+	session.lastActive = time.Now()
+}
+
+func (t *sessionTable) remove(session *tunnelSession) {
+	t.mu.Lock()
+	if t.sessions[session.id] == session {
+		delete(t.sessions, session.id)
+	}
+	t.mu.Unlock()
+	session.close()
+}
+
+func (ts *tunnelSession) close() {
+	// Waits out a concurrent dial, and fails later connects of a session
+	// closed before it dialed.
+	ts.once.Do(func() { ts.err = errSessionClosed })
+	if ts.conn != nil {
+		ts.conn.Close()
+	}
+	// Wait out a concurrent pollOnce.Do so ts.poll is settled.
+	ts.pollOnce.Do(func() {})
+	if ts.poll != nil {
+		ts.poll.close()
+	}
+}
+
+// evictIdle closes sessions that have had no active request for longer than
+// idle, mirroring Durable Object eviction on the Cloudflare server.
+func (t *sessionTable) evictIdle(idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*tunnelSession
+		t.mu.Lock()
+		for id, session := range t.sessions {
+			if session.active == 0 && time.Since(session.lastActive) > idle {
+				delete(t.sessions, id)
+				expired = append(expired, session)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, session := range expired {
+			slog.Info("Session evicted", "protocol", protocolV2, "session", session.id, "idle", idle)
+			session.close()
+		}
+	}
+}
+
+// ============================================================================
+// Server Entry Point
+// ============================================================================
+
+func runServer(args []string) {
+	cfg := ServerConfig{}
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+
+	// Listener Configuration
+	fs.StringVar(&cfg.ListenAddr, "listen", "0.0.0.0:8080", "Cleartext (H2C) listen address, empty = disabled")
+	fs.StringVar(&cfg.ListenAddrTLS, "listen-tls", "", "TLS (H2 and H3) listen address, empty = disabled")
+	fs.StringVar(&cfg.CertFile, "cert", "", "TLS certificate file (PEM)")
+	fs.StringVar(&cfg.KeyFile, "key", "", "TLS private key file (PEM)")
+	fs.BoolVar(&cfg.EnableH3, "h3", true, "Serve HTTP/3 on the TLS listen address")
+
+	// Tunnel Configuration
+	fs.StringVar(&cfg.AuthToken, "token", os.Getenv("PASSWORD"), "Authentication token (default $PASSWORD)")
+	fs.StringVar(&cfg.AuthMode, "auth", authAny, "Accepted authentication schemes: basic, hmac or any")
+	fs.DurationVar(&cfg.AuthWindow, "auth-window", time.Minute, "Maximum clock difference for HMAC signatures")
+	fs.DurationVar(&cfg.ConnTimeout, "conn-timeout", 10*time.Second, "Target connection timeout")
+	fs.DurationVar(&cfg.SessionIdle, "session-idle", 30*time.Second, "Evict V2 sessions idle for this long")
+
+	// Logging
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "Log level: debug, info, warn, error")
+	fs.StringVar(&cfg.LogFormat, "log-format", logFormatText, "Log format: text or json")
+	fs.Parse(args)
+
+	if err := setupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if cfg.AuthToken == "" {
+		fs.Usage()
+		fatal("Authentication token is required")
+	}
+	switch cfg.AuthMode {
+	case authBasic, authHMAC, authAny:
+	default:
+		fatal("Invalid auth mode", "auth", cfg.AuthMode)
+	}
+	if cfg.AuthWindow <= 0 {
+		fatal("-auth-window must be positive")
+	}
+	if cfg.ListenAddrTLS != "" && (cfg.CertFile == "" || cfg.KeyFile == "") {
+		fatal("-cert and -key are required with -listen-tls")
+	}
+	if cfg.ListenAddr == "" && cfg.ListenAddrTLS == "" {
+		fatal("At least one of -listen or -listen-tls is required")
+	}
+	if cfg.SessionIdle <= 0 {
+		fatal("-session-idle must be positive")
+	}
+
+	slog.Info("TCP tunnel server starting...", "version", Version)
+	slog.Info("Accepting authentication scheme", "auth", cfg.AuthMode)
+	if err := NewTunnelServer(cfg).Start(); err != nil {
+		fatal("Failed to start tunnel server", "error", err)
+	}
+}
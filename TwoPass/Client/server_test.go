@@ -0,0 +1,392 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoTarget is a TCP server that echoes every connection back.
+type echoTarget struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	conns  []net.Conn
+	closed chan struct{} // one value per connection that ended
+}
+
+func startEchoTarget(t *testing.T) *echoTarget {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &echoTarget{ln: ln, closed: make(chan struct{}, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			e.mu.Lock()
+			e.conns = append(e.conns, conn)
+			e.mu.Unlock()
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+				e.closed <- struct{}{}
+			}()
+		}
+	}()
+	return e
+}
+
+func (e *echoTarget) header() map[string]string {
+	return map[string]string{
+		"X-Target-Host": "127.0.0.1",
+		"X-Target-Port": strconv.Itoa(e.ln.Addr().(*net.TCPAddr).Port),
+	}
+}
+
+func (e *echoTarget) accepted() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.conns)
+}
+
+// closeAll ends every connection from the target side.
+func (e *echoTarget) closeAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, conn := range e.conns {
+		conn.Close()
+	}
+}
+
+func (e *echoTarget) waitClosed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-e.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("target connection was not closed")
+	}
+}
+
+type testTunnel struct {
+	server *TunnelServer
+	client *http.Client
+	url    string
+	target *echoTarget
+}
+
+// startTestTunnel serves a TunnelServer over HTTP/2 with TLS, in front of an
+// echo target.
+func startTestTunnel(t *testing.T, sessionIdle time.Duration) *testTunnel {
+	t.Helper()
+	s := NewTunnelServer(ServerConfig{
+		AuthToken:   testToken,
+		AuthMode:    authAny,
+		AuthWindow:  time.Minute,
+		ConnTimeout: 2 * time.Second,
+		SessionIdle: sessionIdle,
+	})
+	ts := httptest.NewUnstartedServer(s)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	target := startEchoTarget(t)
+	t.Cleanup(func() {
+		target.ln.Close()
+		target.closeAll()
+		ts.Close()
+	})
+	return &testTunnel{server: s, client: ts.Client(), url: ts.URL + "/tunnel", target: target}
+}
+
+func (tt *testTunnel) request(t *testing.T, method string, body io.Reader, headers ...map[string]string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, tt.url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Basic "+testToken)
+	for _, header := range headers {
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+	}
+	return req
+}
+
+func (tt *testTunnel) do(t *testing.T, req *http.Request) *http.Response {
+	t.Helper()
+	resp, err := tt.client.Do(req)
+	if err != nil {
+		t.Fatalf("%s: %v", req.Method, err)
+	}
+	return resp
+}
+
+// postPacket sends one packet-up upload and returns the status code.
+func (tt *testTunnel) postPacket(t *testing.T, seq int, data string, headers ...map[string]string) int {
+	t.Helper()
+	req := tt.request(t, "POST", strings.NewReader(data), headers...)
+	req.Header.Set(seqHeader, strconv.Itoa(seq))
+	resp := tt.do(t, req)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func readN(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	return string(buf)
+}
+
+func TestServerRejects(t *testing.T) {
+	tun := startTestTunnel(t, time.Minute)
+	target := tun.target.header()
+
+	tests := []struct {
+		name   string
+		method string
+		auth   string // Authorization header, "" for none
+		header map[string]string
+		want   int
+	}{
+		{name: "no credentials", method: "POST", header: target, want: http.StatusUnauthorized},
+		{name: "wrong token", method: "POST", auth: "Basic other", header: target, want: http.StatusUnauthorized},
+		{name: "hmac with wrong token", method: "POST", auth: hmacScheme + " ts=1,nonce=01,sig=x", header: target, want: http.StatusUnauthorized},
+		{name: "missing target", method: "POST", auth: "Basic " + testToken, want: http.StatusBadRequest},
+		{name: "invalid host", method: "POST", auth: "Basic " + testToken, header: map[string]string{"X-Target-Host": "bad host", "X-Target-Port": "80"}, want: http.StatusBadRequest},
+		{name: "invalid port", method: "POST", auth: "Basic " + testToken, header: map[string]string{"X-Target-Host": "127.0.0.1", "X-Target-Port": "0"}, want: http.StatusBadRequest},
+		{name: "v1 get", method: "GET", auth: "Basic " + testToken, header: target, want: http.StatusMethodNotAllowed},
+		{name: "mux v1 get", method: "GET", auth: "Basic " + testToken, header: map[string]string{"X-Mux": muxVersion}, want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tun.request(t, tt.method, nil, tt.header)
+			req.Header.Del("Authorization")
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			resp := tun.do(t, req)
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerV1(t *testing.T) {
+	tun := startTestTunnel(t, time.Minute)
+
+	upload, uploadWriter := io.Pipe()
+	defer uploadWriter.Close()
+	resp := tun.do(t, tun.request(t, "POST", upload, tun.target.header()))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get(capabilityHeader); got != serverCapabilities {
+		t.Errorf("capabilities = %q, want %q", got, serverCapabilities)
+	}
+
+	for _, msg := range []string{"hello", "world"} {
+		uploadWriter.Write([]byte(msg))
+		if got := readN(t, resp.Body, len(msg)); got != msg {
+			t.Errorf("echo = %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestServerV1ConnectionFailed(t *testing.T) {
+	tun := startTestTunnel(t, time.Minute)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	resp := tun.do(t, tun.request(t, "POST", strings.NewReader("x"), map[string]string{"X-Target-Host": "127.0.0.1", "X-Target-Port": port}))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestServerV2Session(t *testing.T) {
+	tun := startTestTunnel(t, time.Minute)
+	session := map[string]string{"X-Session-ID": "join"}
+
+	download := tun.do(t, tun.request(t, "GET", nil, tun.target.header(), session))
+	defer download.Body.Close()
+	if download.StatusCode != http.StatusOK {
+		t.Fatalf("GET status = %d, want 200", download.StatusCode)
+	}
+
+	upload, uploadWriter := io.Pipe()
+	posted := make(chan int, 1)
+	go func() {
+		resp, err := tun.client.Do(tun.request(t, "POST", upload, tun.target.header(), session))
+		if err != nil {
+			posted <- 0
+			return
+		}
+		resp.Body.Close()
+		posted <- resp.StatusCode
+	}()
+
+	uploadWriter.Write([]byte("ping"))
+	if got := readN(t, download.Body, 4); got != "ping" {
+		t.Errorf("download = %q, want %q", got, "ping")
+	}
+	uploadWriter.Close()
+	select {
+	case status := <-posted:
+		if status != http.StatusCreated {
+			t.Errorf("POST status = %d, want 201", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("POST did not complete after the upload ended")
+	}
+	if n := tun.target.accepted(); n != 1 {
+		t.Errorf("target saw %d connections, want the POST and GET to share 1", n)
+	}
+}
+
+func TestServerV2PacketPoll(t *testing.T) {
+	tun := startTestTunnel(t, time.Minute)
+	header := tun.target.header()
+	header["X-Session-ID"] = "packets"
+
+	// Out of order and duplicated packets are reassembled by X-Seq.
+	for _, p := range []struct {
+		seq  int
+		data string
+	}{{1, "world"}, {0, "hello "}, {0, "hello "}, {2, "!"}} {
+		if status := tun.postPacket(t, p.seq, p.data, header); status != http.StatusCreated {
+			t.Fatalf("packet %d status = %d, want 201", p.seq, status)
+		}
+	}
+
+	poll := func(offset int) (int, string) {
+		req := tun.request(t, "GET", nil, header)
+		req.Header.Set(offsetHeader, strconv.Itoa(offset))
+		resp := tun.do(t, req)
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	var received string
+	deadline := time.Now().Add(5 * time.Second)
+	for received != "hello world!" && time.Now().Before(deadline) {
+		status, data := poll(len(received))
+		if status != http.StatusOK {
+			t.Fatalf("poll status = %d, want 200", status)
+		}
+		received += data
+	}
+	if received != "hello world!" {
+		t.Fatalf("polled %q, want %q", received, "hello world!")
+	}
+
+	if status, _ := poll(len(received) + 1); status != http.StatusBadRequest {
+		t.Errorf("poll past the buffered data: status = %d, want 400", status)
+	}
+
+	// Once the target closes, the next poll reports the end of the stream.
+	tun.target.closeAll()
+	status, _ := poll(len(received))
+	for status == http.StatusOK && time.Now().Before(deadline) {
+		status, _ = poll(len(received))
+	}
+	if status != http.StatusNoContent {
+		t.Errorf("poll after target close: status = %d, want 204", status)
+	}
+	tun.server.sessions.mu.Lock()
+	remaining := len(tun.server.sessions.sessions)
+	tun.server.sessions.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("%d sessions left after the stream ended, want 0", remaining)
+	}
+}
+
+func TestServerEvictsIdleSessions(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	tun := startTestTunnel(t, idle)
+	go tun.server.sessions.evictIdle(idle)
+	go tun.server.evictIdleMux(idle)
+
+	t.Run("v2", func(t *testing.T) {
+		header := tun.target.header()
+		header["X-Session-ID"] = "idle-v2"
+		if status := tun.postPacket(t, 0, "x", header); status != http.StatusCreated {
+			t.Fatalf("packet status = %d, want 201", status)
+		}
+		tun.target.waitClosed(t)
+
+		tun.server.sessions.mu.Lock()
+		_, ok := tun.server.sessions.sessions["idle-v2"]
+		tun.server.sessions.mu.Unlock()
+		if ok {
+			t.Error("evicted session still in the session table")
+		}
+	})
+
+	t.Run("mux", func(t *testing.T) {
+		header := map[string]string{"X-Mux": muxVersion, "X-Session-ID": "idle-mux"}
+		open := muxFrame(muxFrameOpen, 1, net.JoinHostPort("127.0.0.1", tun.target.header()["X-Target-Port"]))
+		if status := tun.postPacket(t, 0, string(open), header); status != http.StatusCreated {
+			t.Fatalf("packet status = %d, want 201", status)
+		}
+		tun.target.waitClosed(t)
+
+		tun.server.muxMu.Lock()
+		_, ok := tun.server.muxSessions["idle-mux"]
+		tun.server.muxMu.Unlock()
+		if ok {
+			t.Error("evicted mux session still in the session table")
+		}
+	})
+}
+
+func TestServerKeepsActiveSessions(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	tun := startTestTunnel(t, idle)
+	go tun.server.sessions.evictIdle(idle)
+
+	// A streaming download keeps its session active however long it idles.
+	session := map[string]string{"X-Session-ID": "active"}
+	download := tun.do(t, tun.request(t, "GET", nil, tun.target.header(), session))
+	defer download.Body.Close()
+	time.Sleep(4 * idle)
+
+	if status := tun.postPacket(t, 0, "still here", tun.target.header(), session); status != http.StatusCreated {
+		t.Fatalf("packet status = %d, want 201", status)
+	}
+	if got := readN(t, download.Body, len("still here")); got != "still here" {
+		t.Errorf("download = %q, want %q", got, "still here")
+	}
+	if n := tun.target.accepted(); n != 1 {
+		t.Errorf("target saw %d connections, want 1", n)
+	}
+}
+
+func TestTunnelSessionCloseBeforeConnect(t *testing.T) {
+	ts := &tunnelSession{id: "closed"}
+	ts.close()
+	if err := ts.connect(&net.Dialer{}, "127.0.0.1:1"); err != errSessionClosed {
+		t.Errorf("connect after close = %v, want %v", err, errSessionClosed)
+	}
+}
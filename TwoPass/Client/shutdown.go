@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Tunnel Tracking and Graceful Shutdown
+// ============================================================================
+//
+// Hijacked CONNECT and SOCKS5 connections are invisible to
+// http.Server.Shutdown, so every tunnel registers with a tunnelTracker shared
+// by all proxy generations. On SIGTERM/SIGINT the listeners are closed, live
+// tunnels get up to -drain-timeout to finish, and the rest are cancelled.
+
+// shutdownGrace is how long cancelled tunnels get to unwind before Shutdown
+// returns anyway.
+const shutdownGrace = 2 * time.Second
+
+type tunnelTracker struct {
+	ctx    context.Context // cancelled to abort every remaining tunnel
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	tunnels map[*liveTunnel]struct{}
+	drained chan struct{} // closed when the last tunnel ends, if someone waits
+}
+
+// liveTunnel describes one open tunnel for the admin API.
+type liveTunnel struct {
+	id       string
+	client   string
+	target   string
+	protocol string
+	upstream string
+	started  time.Time
+
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+	cancel    context.CancelFunc
+
+	// For the access log; see accesslog.go.
+	mu          sync.Mutex
+	httpPOST    string
+	httpGET     string
+	statusPOST  int
+	statusGET   int
+	setup       time.Duration
+	closeReason string
+}
+
+func newTunnelTracker() *tunnelTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tunnelTracker{ctx: ctx, cancel: cancel, tunnels: make(map[*liveTunnel]struct{})}
+}
+
+// openTunnel registers a tunnel with the tracker and the metrics. It returns
+// the tunnel context, which carries the tunnel and its logger, the client
+// connection wrapped for byte counting, and the function to call when the
+// tunnel ends, which also writes the access log record. upstream is empty for
+// direct connections.
+func (p *Proxy) openTunnel(ctx context.Context, protocol, id, upstream string, clientConn net.Conn, targetHost, targetPort string) (context.Context, net.Conn, func()) {
+	tunnel := &liveTunnel{
+		id:       id,
+		client:   clientConn.RemoteAddr().String(),
+		target:   net.JoinHostPort(strings.Trim(targetHost, "[]"), targetPort),
+		protocol: protocol,
+		upstream: upstream,
+		started:  time.Now(),
+	}
+	ctx, untrack := p.tunnels.track(ctx, tunnel)
+	ctx = context.WithValue(ctx, tunnelKey{}, tunnel)
+	logger := slog.With("session", id, "target", tunnel.target, "protocol", protocol)
+	if upstream != "" {
+		logger = logger.With("upstream", upstream)
+	}
+	ctx = withLogger(ctx, logger)
+	closed := p.metrics.trackTunnel(protocol)
+	return ctx, p.metrics.countConn(clientConn, protocol, tunnel), func() {
+		closed()
+		untrack()
+		if p.accessLog != nil {
+			p.accessLog.write(tunnel)
+		}
+	}
+}
+
+// track registers a tunnel. The returned context is also cancelled when the
+// tunnel is closed through the admin API or the tracker aborts all tunnels;
+// done must be called when the tunnel ends.
+func (t *tunnelTracker) track(ctx context.Context, tunnel *liveTunnel) (context.Context, func()) {
+	ctx, tunnel.cancel = context.WithCancel(ctx)
+	stop := context.AfterFunc(t.ctx, func() {
+		tunnel.closing(closeShutdown)
+		tunnel.cancel()
+	})
+
+	t.mu.Lock()
+	t.tunnels[tunnel] = struct{}{}
+	t.mu.Unlock()
+
+	return ctx, func() {
+		stop()
+		tunnel.cancel()
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.tunnels, tunnel)
+		if len(t.tunnels) == 0 && t.drained != nil {
+			close(t.drained)
+			t.drained = nil
+		}
+	}
+}
+
+// list returns the open tunnels, oldest first.
+func (t *tunnelTracker) list() []*liveTunnel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tunnels := make([]*liveTunnel, 0, len(t.tunnels))
+	for tunnel := range t.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	slices.SortFunc(tunnels, func(a, b *liveTunnel) int { return a.started.Compare(b.started) })
+	return tunnels
+}
+
+// closeTunnel cancels the tunnel with the given ID and reports whether it existed.
+func (t *tunnelTracker) closeTunnel(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tunnel := range t.tunnels {
+		if tunnel.id == id {
+			tunnel.closing(closeAdmin)
+			tunnel.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tunnelTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.tunnels)
+}
+
+// wait blocks until no tunnel is active or ctx ends, and reports whether
+// every tunnel finished.
+func (t *tunnelTracker) wait(ctx context.Context) bool {
+	t.mu.Lock()
+	if len(t.tunnels) == 0 {
+		t.mu.Unlock()
+		return true
+	}
+	if t.drained == nil {
+		t.drained = make(chan struct{})
+	}
+	drained := t.drained
+	t.mu.Unlock()
+
+	select {
+	case <-drained:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// addListener and addServer register what Shutdown has to close.
+func (p *Proxy) addListener(l net.Listener) {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	p.listeners = append(p.listeners, l)
+}
+
+func (p *Proxy) addServer(server *http.Server) {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	p.servers = append(p.servers, server)
+}
+
+// Shutdown stops accepting connections and waits for live tunnels until ctx
+// ends, then cancels the tunnels that are left.
+func (p *Proxy) Shutdown(ctx context.Context) {
+	slog.Info("Shutting down, draining active tunnels", "tunnels", p.tunnels.count())
+
+	p.listenersMu.Lock()
+	listeners, servers := p.listeners, p.servers
+	p.listenersMu.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	// Waits for forwarded requests; hijacked connections are left to us.
+	for _, server := range servers {
+		server.Shutdown(ctx)
+	}
+
+	// Forwarded requests ride on keep-alive tunnels that would otherwise stay
+	// open until the drain timeout.
+	p.current().closeIdleForwardConnections()
+
+	if p.tunnels.wait(ctx) {
+		slog.Info("All tunnels closed")
+		return
+	}
+
+	slog.Warn("Drain timeout reached, closing remaining tunnels", "tunnels", p.tunnels.count())
+	p.tunnels.cancel()
+	graceCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if !p.tunnels.wait(graceCtx) {
+		slog.Error("Tunnels did not close in time", "tunnels", p.tunnels.count())
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ============================================================================
+// Host Sniffing
+// ============================================================================
+//
+// Transparent connections, and SOCKS5 clients that resolve names themselves,
+// only give the proxy an IP address. With -sniff that IP is replaced by the
+// name the client asks for, so domain rules apply and the upstream resolves
+// it. sniffHost peeks at what the client sends first. A TLS ClientHello yields
+// its server_name extension and an HTTP request its Host header. Everything
+// peeked is replayed into the tunnel. Protocols where the server speaks first
+// send nothing, so sniffing gives up after a short wait.
+
+const (
+	sniffTimeout       = 300 * time.Millisecond
+	sniffMaxHTTPHeader = 4096
+
+	tlsRecordHeaderLen    = 5
+	tlsMaxRecordLen       = 16384
+	tlsRecordHandshake    = 0x16
+	tlsClientHello        = 0x01
+	tlsExtServerName      = 0x0000
+	tlsServerNameHostName = 0x00
+)
+
+// sniffTarget returns conn, replaying whatever was peeked, and the sniffed
+// host name, or targetHost if none was found.
+func (p *Proxy) sniffTarget(conn net.Conn, protocol, targetHost, targetPort string) (net.Conn, string) {
+	addr := net.JoinHostPort(strings.Trim(targetHost, "[]"), targetPort)
+	conn, host := sniffHost(conn)
+	if host == "" {
+		slog.Debug("No host name sniffed", "protocol", protocol, "addr", addr)
+		return conn, targetHost
+	}
+	slog.Debug("Sniffed target host", "protocol", protocol, "addr", addr, "host", host)
+	return conn, host
+}
+
+// isIPHost reports whether a target host is an IP literal, bracketed or not.
+func isIPHost(host string) bool {
+	_, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	return err == nil
+}
+
+// sniffHost returns a connection that replays the peeked bytes and the host
+// name found in them, or "".
+func sniffHost(conn net.Conn) (net.Conn, string) {
+	r := bufio.NewReaderSize(conn, tlsRecordHeaderLen+tlsMaxRecordLen)
+	pc := &peekConn{Conn: conn, r: r}
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	first, err := r.Peek(1)
+	if err != nil {
+		return pc, ""
+	}
+
+	var host string
+	switch {
+	case first[0] == tlsRecordHandshake:
+		host = sniffTLS(r)
+	case first[0] >= 'A' && first[0] <= 'Z':
+		host = sniffHTTP(r)
+	}
+	if !isHostname(host) {
+		return pc, ""
+	}
+	return pc, strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// sniffTLS reads the server name from a ClientHello that fits in the first
+// record, which is the case for every common client.
+func sniffTLS(r *bufio.Reader) string {
+	header, err := r.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLen {
+		return ""
+	}
+	record, err := r.Peek(tlsRecordHeaderLen + length)
+	if err != nil {
+		return ""
+	}
+	return parseClientHelloSNI(record[tlsRecordHeaderLen:])
+}
+
+func parseClientHelloSNI(data []byte) string {
+	s := cryptobyte.String(data)
+	var msgType uint8
+	var hello cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != tlsClientHello || !s.ReadUint24LengthPrefixed(&hello) {
+		return ""
+	}
+
+	// legacy_version, random, session ID, cipher suites, compression methods
+	var sessionID, ciphers, compression, extensions cryptobyte.String
+	if !hello.Skip(2+32) ||
+		!hello.ReadUint8LengthPrefixed(&sessionID) ||
+		!hello.ReadUint16LengthPrefixed(&ciphers) ||
+		!hello.ReadUint8LengthPrefixed(&compression) ||
+		!hello.ReadUint16LengthPrefixed(&extensions) {
+		return ""
+	}
+
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return ""
+		}
+		if extType != tlsExtServerName {
+			continue
+		}
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == tlsServerNameHostName {
+				return string(name)
+			}
+		}
+	}
+	return ""
+}
+
+// sniffHTTP reads the Host header once the request headers are complete.
+func sniffHTTP(r *bufio.Reader) string {
+	for {
+		data, _ := r.Peek(r.Buffered())
+		if !looksLikeHTTPMethod(data) {
+			return ""
+		}
+		if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data[:end+4])))
+			if err != nil {
+				return ""
+			}
+			if host, _, err := net.SplitHostPort(req.Host); err == nil {
+				return host
+			}
+			return req.Host
+		}
+		if len(data) >= sniffMaxHTTPHeader {
+			return ""
+		}
+		if _, err := r.Peek(len(data) + 1); err != nil {
+			return ""
+		}
+	}
+}
+
+// looksLikeHTTPMethod reports whether data starts with an upper-case token
+// that is, or may still become, a request method followed by a space.
+func looksLikeHTTPMethod(data []byte) bool {
+	for i, c := range data {
+		if c == ' ' {
+			return i > 0
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// isHostname accepts domain names and rejects IP literals, which would not
+// improve on the address the connection already has.
+func isHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
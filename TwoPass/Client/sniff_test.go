@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// clientHelloRecord returns the first TLS record crypto/tls sends for
+// serverName.
+func clientHelloRecord(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("read record header: %v", err)
+	}
+	record := make([]byte, tlsRecordHeaderLen+int(binary.BigEndian.Uint16(header[3:5])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[tlsRecordHeaderLen:]); err != nil {
+		t.Fatalf("read record: %v", err)
+	}
+	return record
+}
+
+// clientHello builds a handshake message with the given extensions.
+func clientHello(extensions func(*cryptobyte.Builder)) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(tlsClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.VersionTLS12)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8LengthPrefixed(func(*cryptobyte.Builder) {})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(tls.TLS_AES_128_GCM_SHA256) })
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		b.AddUint16LengthPrefixed(extensions)
+	})
+	return b.BytesOrPanic()
+}
+
+func serverNameExtension(nameType uint8, name string) func(*cryptobyte.Builder) {
+	return func(b *cryptobyte.Builder) {
+		b.AddUint16(tlsExtServerName)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(nameType)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(name)) })
+			})
+		})
+	}
+}
+
+func TestParseClientHelloSNI(t *testing.T) {
+	hello := clientHelloRecord(t, "www.example.com")[tlsRecordHeaderLen:]
+	wrongType := bytes.Clone(hello)
+	wrongType[0] = 0x02 // ServerHello
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "crypto/tls", data: hello, want: "www.example.com"},
+		{name: "crypto/tls without server name", data: clientHelloRecord(t, "")[tlsRecordHeaderLen:]},
+		{name: "crypto/tls to an IP", data: clientHelloRecord(t, "192.0.2.1")[tlsRecordHeaderLen:]},
+		{name: "truncated", data: hello[:len(hello)-10]},
+		{name: "not a ClientHello", data: wrongType},
+		{name: "empty", data: nil},
+		{
+			name: "server name after other extensions",
+			data: clientHello(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x002b) // supported_versions
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(tls.VersionTLS13) })
+				})
+				serverNameExtension(tlsServerNameHostName, "example.org")(b)
+			}),
+			want: "example.org",
+		},
+		{
+			name: "unknown name type",
+			data: clientHello(serverNameExtension(0x01, "example.org")),
+		},
+		{
+			name: "no extensions",
+			data: clientHello(func(*cryptobyte.Builder) {}),
+		},
+		{
+			name: "malformed server name list",
+			data: clientHello(func(b *cryptobyte.Builder) {
+				b.AddUint16(tlsExtServerName)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseClientHelloSNI(tt.data); got != tt.want {
+				t.Errorf("parseClientHelloSNI = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "host", input: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", want: "example.com"},
+		{name: "host with port", input: "POST /x HTTP/1.1\r\nHost: example.com:8080\r\nContent-Length: 3\r\n\r\nabc", want: "example.com"},
+		{name: "ipv6 host", input: "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", want: "2001:db8::1"},
+		{name: "absolute form", input: "GET http://example.net/ HTTP/1.1\r\nHost: example.com\r\n\r\n", want: "example.net"},
+		{name: "no host", input: "GET / HTTP/1.0\r\n\r\n"},
+		{name: "incomplete headers", input: "GET / HTTP/1.1\r\nHost: example.com\r\n"},
+		{name: "malformed request line", input: "GET /\r\nHost: example.com\r\n\r\n"},
+		{name: "server speaks first", input: "SSH-2.0-OpenSSH_9.6\r\n"},
+		{name: "lower case method", input: "get / HTTP/1.1\r\nHost: example.com\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tt.input), tlsRecordHeaderLen+tlsMaxRecordLen)
+			if got := sniffHTTP(r); got != tt.want {
+				t.Errorf("sniffHTTP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// onceSource serves data once, then fails the test if read again.
+type onceSource struct {
+	t    *testing.T
+	data []byte
+}
+
+func (s *onceSource) Read(b []byte) (int, error) {
+	if len(s.data) == 0 {
+		s.t.Error("sniffHTTP kept reading past the header limit")
+		return 0, io.EOF
+	}
+	n := copy(b, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func TestSniffHTTPHeaderLimit(t *testing.T) {
+	src := &onceSource{t: t, data: []byte("GET / HTTP/1.1\r\nHost: example.com\r\nX-Pad: " + strings.Repeat("a", sniffMaxHTTPHeader))}
+	r := bufio.NewReaderSize(src, tlsRecordHeaderLen+tlsMaxRecordLen)
+	if got := sniffHTTP(r); got != "" {
+		t.Errorf("sniffHTTP = %q, want \"\" for unterminated headers over %d bytes", got, sniffMaxHTTPHeader)
+	}
+}
+
+func TestLooksLikeHTTPMethod(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{"", true},
+		{"GE", true},
+		{"CONNECT ", true},
+		{"GET / HTTP/1.1", true},
+		{" GET", false},
+		{"Get ", false},
+		{"SSH-2.0", false},
+		{"\x16\x03\x01", false},
+	}
+	for _, tt := range tests {
+		if got := looksLikeHTTPMethod([]byte(tt.data)); got != tt.want {
+			t.Errorf("looksLikeHTTPMethod(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"Example.COM.", true},
+		{"localhost", true},
+		{"_dmarc.example.com", true},
+		{"xn--bcher-kva.example", true},
+		{"", false},
+		{"192.0.2.1", false},
+		{"2001:db8::1", false},
+		{"::ffff:192.0.2.1", false},
+		{"example.com:443", false},
+		{"exa mple.com", false},
+		{"bücher.example", false},
+		{"example.com\x00", false},
+		{strings.Repeat("a", 254), false},
+		{strings.Repeat("a", 253), true},
+	}
+	for _, tt := range tests {
+		if got := isHostname(tt.host); got != tt.want {
+			t.Errorf("isHostname(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestSniffHost(t *testing.T) {
+	tests := []struct {
+		name string
+		send []byte
+		want string
+	}{
+		{name: "tls", send: clientHelloRecord(t, "WWW.Example.com"), want: "www.example.com"},
+		{name: "http", send: []byte("GET / HTTP/1.1\r\nHost: example.com.\r\n\r\n"), want: "example.com"},
+		{name: "http to an IP", send: []byte("GET / HTTP/1.1\r\nHost: 192.0.2.1\r\n\r\n")},
+		{name: "other protocol", send: []byte("\x00\x01binary")},
+		{name: "nothing sent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				if len(tt.send) > 0 {
+					client.Write(tt.send)
+				}
+			}()
+
+			start := time.Now()
+			conn, host := sniffHost(server)
+			defer conn.Close()
+			if host != tt.want {
+				t.Errorf("sniffHost host = %q, want %q", host, tt.want)
+			}
+			if len(tt.send) == 0 {
+				if elapsed := time.Since(start); elapsed < sniffTimeout {
+					t.Errorf("sniffHost gave up after %v, before the %v timeout", elapsed, sniffTimeout)
+				}
+				return
+			}
+
+			// Everything peeked is replayed to the tunnel.
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got := make([]byte, len(tt.send))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("read replayed bytes: %v", err)
+			}
+			if !bytes.Equal(got, tt.send) {
+				t.Errorf("replayed % x, want % x", got, tt.send)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ============================================================================
+// SOCKS5 Constants
+// ============================================================================
+
+const (
+	protocolSOCKS = "socks"
+
+	socks5Version     = 0x05
+	socks5AuthVersion = 0x01
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddrNotSupported    = 0x08
+)
+
+var errSOCKS5AuthFailed = errors.New("authentication failed")
+
+// ============================================================================
+// SOCKS5 Listener
+// ============================================================================
+
+func (p *Proxy) startSOCKS5() error {
+	listener, err := net.Listen("tcp", p.config.SOCKSListenAddr)
+	if err != nil {
+		return err
+	}
+	p.addListener(listener)
+	slog.Info("Listening for SOCKS5 connections", "addr", p.config.SOCKSListenAddr)
+	if p.config.SOCKSUsername != "" || p.config.ProxyUsers != nil {
+		slog.Info("SOCKS5 username/password authentication is enabled")
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.current().handleSOCKS5(conn)
+	}
+}
+
+func (p *Proxy) handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	slog.Debug("Accepted SOCKS5 connection", "client", client)
+	if !p.clientAllowed(client) {
+		slog.Warn("Client address not allowed", "protocol", protocolSOCKS, "client", client)
+		return
+	}
+
+	// A client that stalls mid-handshake must not hold the connection forever.
+	if p.config.ConnTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.config.ConnTimeout))
+	}
+	user, err := p.socks5Negotiate(conn)
+	if err != nil {
+		slog.Warn("Handshake failed", "protocol", protocolSOCKS, "client", client, "error", err)
+		return
+	}
+
+	targetHost, targetPort, err := socks5ReadRequest(conn)
+	if err != nil {
+		slog.Warn("Invalid request", "protocol", protocolSOCKS, "client", client, "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	target := net.JoinHostPort(targetHost, targetPort)
+	slog.Info("Proxy request", "protocol", protocolSOCKS, "client", client, "target", target)
+
+	targetHost, targetPort, err = parseAndFormatTarget(target)
+	if err != nil {
+		slog.Warn("Invalid target host format", "protocol", protocolSOCKS, "target", target)
+		socks5WriteReply(conn, socks5ReplyGeneralFailure)
+		return
+	}
+
+	// The client only sends its first bytes after a successful reply, so a
+	// sniffed target is routed after replying. Blocked or unreachable targets
+	// then just see the connection closed.
+	dialHost := targetHost
+	replied := false
+	if p.config.Sniff && isIPHost(targetHost) {
+		if err := socks5WriteReply(conn, socks5ReplySucceeded); err != nil {
+			slog.Log(context.Background(), errorLevel(err), "Failed to write reply", "protocol", protocolSOCKS, "client", client, "error", err)
+			return
+		}
+		replied = true
+		conn, targetHost = p.sniffTarget(conn, protocolSOCKS, targetHost, targetPort)
+		target = net.JoinHostPort(strings.Trim(targetHost, "[]"), targetPort)
+	}
+
+	var targetConn net.Conn
+	rt := p.routeFor(target)
+	if rt.upstream == "" {
+		rt.upstream = user.upstream
+	}
+	switch rt.action {
+	case routeBlock:
+		slog.Info("Request blocked by rule", "protocol", protocolSOCKS, "client", client, "target", target)
+		if !replied {
+			socks5WriteReply(conn, socks5ReplyNotAllowed)
+		}
+		return
+	case routeDirect:
+		// Dial the requested address, not a sniffed name that may resolve
+		// elsewhere.
+		if targetConn, err = p.dialDirect(context.Background(), dialHost, targetPort); err != nil {
+			slog.Warn("Direct connection failed", "protocol", protocolSOCKS, "target", target, "error", err)
+			if !replied {
+				socks5WriteReply(conn, socks5ReplyHostUnreachable)
+			}
+			return
+		}
+	}
+
+	if p.config.StreamTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.config.StreamTimeout))
+	}
+	if !replied {
+		if err := socks5WriteReply(conn, socks5ReplySucceeded); err != nil {
+			slog.Log(context.Background(), errorLevel(err), "Failed to write reply", "protocol", protocolSOCKS, "client", client, "error", err)
+			if targetConn != nil {
+				targetConn.Close()
+			}
+			return
+		}
+	}
+
+	if targetConn != nil {
+		p.relayDirect(context.Background(), conn, targetConn, targetHost, targetPort)
+	} else {
+		p.tunnel(context.Background(), p.upstreamFor(rt), conn, targetHost, targetPort)
+	}
+	slog.Debug("Connection closed", "protocol", protocolSOCKS, "target", target)
+}
+
+// ============================================================================
+// SOCKS5 Wire Format
+// ============================================================================
+
+// socks5Negotiate selects the authentication method and returns the
+// authenticated user. The user is empty without -proxy-users.
+func (p *Proxy) socks5Negotiate(conn net.Conn) (proxyUser, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return proxyUser{}, err
+	}
+	if header[0] != socks5Version {
+		return proxyUser{}, fmt.Errorf("unsupported version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return proxyUser{}, err
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if p.config.SOCKSUsername != "" || p.config.ProxyUsers != nil {
+		want = socks5MethodUserPass
+	}
+	if !slices.Contains(methods, want) {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return proxyUser{}, errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, want}); err != nil {
+		return proxyUser{}, err
+	}
+
+	if want == socks5MethodUserPass {
+		return p.socks5Authenticate(conn)
+	}
+	return proxyUser{}, nil
+}
+
+// socks5Authenticate implements the username/password sub-negotiation (RFC 1929).
+// It accepts the -socks-user credentials and, with -proxy-users, any user of
+// the users file.
+func (p *Proxy) socks5Authenticate(conn net.Conn) (proxyUser, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return proxyUser{}, err
+	}
+	if header[0] != socks5AuthVersion {
+		return proxyUser{}, fmt.Errorf("unsupported auth version: %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return proxyUser{}, err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return proxyUser{}, err
+	}
+	password := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return proxyUser{}, err
+	}
+
+	user, ok := proxyUser{}, false
+	if p.config.SOCKSUsername != "" {
+		userOK := subtle.ConstantTimeCompare(username, []byte(p.config.SOCKSUsername)) == 1
+		passOK := subtle.ConstantTimeCompare(password, []byte(p.config.SOCKSPassword)) == 1
+		ok = userOK && passOK
+	}
+	if !ok && p.config.ProxyUsers != nil {
+		user, ok = p.config.ProxyUsers.check(string(username), string(password))
+	}
+	if !ok {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return proxyUser{}, errSOCKS5AuthFailed
+	}
+	_, err := conn.Write([]byte{socks5AuthVersion, 0x00})
+	return user, err
+}
+
+func socks5ReadRequest(conn net.Conn) (string, string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5Version {
+		return "", "", fmt.Errorf("unsupported version: %d", header[0])
+	}
+	if header[1] != socks5CmdConnect {
+		socks5WriteReply(conn, socks5ReplyCommandNotSupported)
+		return "", "", fmt.Errorf("unsupported command: %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if header[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		addr := make([]byte, size)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return "", "", err
+		}
+		host = net.IP(addr).String()
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return "", "", err
+		}
+		domain := make([]byte, header[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", "", err
+		}
+		host = string(domain)
+	default:
+		socks5WriteReply(conn, socks5ReplyAddrNotSupported)
+		return "", "", fmt.Errorf("unsupported address type: %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(port))), nil
+}
+
+func socks5WriteReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socks5Version, reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ============================================================================
+// Transparent Proxy (Linux)
+// ============================================================================
+//
+// -transparent accepts TCP connections that netfilter redirected to it, for
+// example with
+//
+//	iptables -t nat -A OUTPUT -p tcp -m owner ! --uid-owner twopass -j REDIRECT --to-ports 12345
+//
+// and recovers their original destination with SO_ORIGINAL_DST. The
+// destination is an IP address; with -sniff the client reads the TLS server
+// name or HTTP Host from the first bytes and tunnels to that domain instead.
+// The client's own connections must be excluded from the redirect, here by
+// running it as the twopass user.
+
+const protocolTransparent = "transparent"
+
+func (p *Proxy) startTransparent() error {
+	listener, err := net.Listen("tcp", p.config.TransparentAddr)
+	if err != nil {
+		return err
+	}
+	p.addListener(listener)
+	slog.Info("Listening for transparent connections", "addr", p.config.TransparentAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.current().handleTransparent(conn)
+	}
+}
+
+func (p *Proxy) handleTransparent(conn net.Conn) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	slog.Debug("Accepted transparent connection", "client", client)
+	if !p.clientAllowed(client) {
+		slog.Warn("Client address not allowed", "protocol", protocolTransparent, "client", client)
+		return
+	}
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		slog.Warn("Failed to read original destination", "protocol", protocolTransparent, "client", client, "error", err)
+		return
+	}
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.AddrPort().Addr().Unmap() == dst.Addr().Unmap() && local.AddrPort().Port() == dst.Port() {
+		slog.Warn("Connection was not redirected, refusing to loop", "protocol", protocolTransparent, "client", client)
+		return
+	}
+
+	targetHost, port := dst.Addr().Unmap().String(), strconv.Itoa(int(dst.Port()))
+	if p.config.Sniff {
+		conn, targetHost = p.sniffTarget(conn, protocolTransparent, targetHost, port)
+	}
+	target := net.JoinHostPort(targetHost, port)
+	slog.Info("Proxy request", "protocol", protocolTransparent, "client", client, "target", target)
+
+	targetHost, targetPort, err := parseAndFormatTarget(target)
+	if err != nil {
+		slog.Warn("Invalid target host format", "protocol", protocolTransparent, "target", target)
+		return
+	}
+
+	var targetConn net.Conn
+	rt := p.routeFor(target)
+	switch rt.action {
+	case routeBlock:
+		slog.Info("Request blocked by rule", "protocol", protocolTransparent, "client", client, "target", target)
+		return
+	case routeDirect:
+		// Dial the original address, not a sniffed name that may resolve
+		// elsewhere.
+		if targetConn, err = p.dialDirect(context.Background(), dst.Addr().Unmap().String(), port); err != nil {
+			slog.Warn("Direct connection failed", "protocol", protocolTransparent, "target", target, "error", err)
+			return
+		}
+	}
+
+	if p.config.StreamTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.config.StreamTimeout))
+	}
+	if targetConn != nil {
+		p.relayDirect(context.Background(), conn, targetConn, targetHost, targetPort)
+	} else {
+		p.tunnel(context.Background(), p.upstreamFor(rt), conn, targetHost, targetPort)
+	}
+	slog.Debug("Connection closed", "protocol", protocolTransparent, "target", target)
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST (SOL_IP) and IP6T_SO_ORIGINAL_DST
+// (SOL_IPV6), which share the same value.
+const soOriginalDst = 80
+
+const transparentSupported = true
+
+// originalDst asks conntrack for the address a REDIRECTed connection was sent
+// to. The syscall package has no getsockopt helper for sockaddrs, so IPv4
+// reads the 16-byte sockaddr_in through the one for ipv6_mreq: the port is in
+// bytes 2-3, big endian, and the address in bytes 4-7. IPv6 reads the
+// sockaddr_in6 through the one for ip6_mtuinfo, which starts with one.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ipv4 := tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			var sa *syscall.IPv6Mreq
+			if sa, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); sockErr == nil {
+				addr := netip.AddrFrom4([4]byte(sa.Multiaddr[4:8]))
+				dst = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(sa.Multiaddr[2:4]))
+			}
+			return
+		}
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); sockErr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return dst, sockErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+const transparentSupported = false
+
+func originalDst(net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("transparent mode is only supported on Linux")
+}
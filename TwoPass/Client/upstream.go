@@ -0,0 +1,667 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================================
+// Upstream Types
+// ============================================================================
+
+const (
+	policyFailover      = "failover"
+	policyRoundRobin    = "round-robin"
+	policyLowestLatency = "lowest-latency"
+
+	// Consecutive tunnel failures before an upstream is marked unhealthy
+	// without waiting for the next health probe.
+	upstreamMaxFailures = 3
+
+	// Capability exchange: the client announces what it speaks and servers
+	// answer with the protocol versions they support.
+	capabilityHeader   = "X-TwoPass-Versions"
+	clientCapabilities = "1,2,mux,packet,poll"
+)
+
+type UpstreamConfig struct {
+	Name            string
+	URLPOST         string
+	URLGET          string
+	Addr            string
+	AuthToken       string
+	AuthScheme      string
+	HTTPVersionPOST string
+	HTTPVersionGET  string
+	SNIPOST         string
+	SNIGET          string
+	HostPOST        string
+	HostGET         string
+}
+
+type upstream struct {
+	config          UpstreamConfig
+	httpClientPOST  *http.Client
+	httpClientGET   *http.Client
+	httpVersionPOST string // resolved, never "auto"
+	httpVersionGET  string
+	mux             *muxClient
+	metrics         *metrics
+
+	mu        sync.Mutex
+	healthy   bool
+	latency   time.Duration
+	failures  int
+	lastError string
+
+	// Protocol negotiation state
+	capabilities     map[string]bool
+	v2Failures       int
+	fallbackUntil    time.Time
+	fallbackCooldown time.Duration
+}
+
+type upstreamPool struct {
+	upstreams []*upstream
+	policy    string
+	next      atomic.Uint64
+	pinned    atomic.Pointer[upstream] // set through the admin API
+	stop      chan struct{}
+}
+
+// ============================================================================
+// Upstream Configuration
+// ============================================================================
+
+// upstreamList collects repeated -upstream flags of the form
+// "name=cf,url=https://example.com/tunnel,token=secret,http=h2,addr=1.2.3.4".
+type upstreamList []UpstreamConfig
+
+func (l *upstreamList) String() string {
+	names := make([]string, len(*l))
+	for i, up := range *l {
+		names[i] = up.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *upstreamList) Set(value string) error {
+	up, err := parseUpstreamSpec(value)
+	if err != nil {
+		return err
+	}
+	if up.Name == "" {
+		up.Name = fmt.Sprintf("upstream%d", len(*l)+1)
+	}
+	*l = append(*l, up)
+	return nil
+}
+
+func parseUpstreamSpec(spec string) (UpstreamConfig, error) {
+	var up UpstreamConfig
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return up, fmt.Errorf("invalid upstream field %q (want key=value)", field)
+		}
+		switch key {
+		case "name":
+			up.Name = value
+		case "url":
+			up.URLPOST, up.URLGET = value, value
+		case "url-post":
+			up.URLPOST = value
+		case "url-get":
+			up.URLGET = value
+		case "addr":
+			up.Addr = value
+		case "token":
+			up.AuthToken = value
+		case "token-file":
+			token, err := readTokenFile(value)
+			if err != nil {
+				return up, err
+			}
+			up.AuthToken = token
+		case "auth":
+			up.AuthScheme = value
+		case "http":
+			up.HTTPVersionPOST, up.HTTPVersionGET = value, value
+		case "http-post":
+			up.HTTPVersionPOST = value
+		case "http-get":
+			up.HTTPVersionGET = value
+		case "sni":
+			up.SNIPOST, up.SNIGET = value, value
+		case "sni-post":
+			up.SNIPOST = value
+		case "sni-get":
+			up.SNIGET = value
+		case "host":
+			up.HostPOST, up.HostGET = value, value
+		case "host-post":
+			up.HostPOST = value
+		case "host-get":
+			up.HostGET = value
+		default:
+			return up, fmt.Errorf("unknown upstream field %q", key)
+		}
+	}
+	return up, nil
+}
+
+// upstreamConfigs returns the effective upstream list: the -upstream entries
+// with defaults taken from the global flags, or a single upstream built from
+// the global flags when none are given.
+func (cfg *Config) upstreamConfigs() []UpstreamConfig {
+	if len(cfg.Upstreams) == 0 {
+		return []UpstreamConfig{{
+			Name:            "default",
+			URLPOST:         cfg.UpstreamURLPOST,
+			URLGET:          cfg.UpstreamURLGET,
+			Addr:            cfg.UpstreamAddr,
+			AuthToken:       cfg.AuthToken,
+			AuthScheme:      cfg.AuthScheme,
+			HTTPVersionPOST: cfg.HTTPVersionPOST,
+			HTTPVersionGET:  cfg.HTTPVersionGET,
+			SNIPOST:         cfg.SNIPOST,
+			SNIGET:          cfg.SNIGET,
+			HostPOST:        cfg.HostPOST,
+			HostGET:         cfg.HostGET,
+		}}
+	}
+
+	upstreams := make([]UpstreamConfig, len(cfg.Upstreams))
+	for i, up := range cfg.Upstreams {
+		if up.URLGET == "" {
+			up.URLGET = up.URLPOST
+		}
+		if up.AuthToken == "" {
+			up.AuthToken = cfg.AuthToken
+		}
+		if up.AuthScheme == "" {
+			up.AuthScheme = cfg.AuthScheme
+		}
+		if up.HTTPVersionPOST == "" {
+			up.HTTPVersionPOST = cfg.HTTPVersionPOST
+		}
+		if up.HTTPVersionGET == "" {
+			up.HTTPVersionGET = cfg.HTTPVersionGET
+		}
+		if up.SNIPOST == "" {
+			up.SNIPOST = cfg.SNIPOST
+		}
+		if up.SNIGET == "" {
+			up.SNIGET = cfg.SNIGET
+		}
+		if up.HostPOST == "" {
+			up.HostPOST = cfg.HostPOST
+		}
+		if up.HostGET == "" {
+			up.HostGET = cfg.HostGET
+		}
+		upstreams[i] = up
+	}
+	return upstreams
+}
+
+func validateUpstreams(upstreams []UpstreamConfig) error {
+	seen := make(map[string]bool)
+	for _, up := range upstreams {
+		if up.URLPOST == "" || up.URLGET == "" || up.AuthToken == "" {
+			return fmt.Errorf("upstream %s: URLs and authentication token are required", up.Name)
+		}
+		if up.AuthScheme != authBasic && up.AuthScheme != authHMAC {
+			return fmt.Errorf("upstream %s: invalid auth scheme %q (want basic or hmac)", up.Name, up.AuthScheme)
+		}
+		for _, version := range []string{up.HTTPVersionPOST, up.HTTPVersionGET} {
+			if !validHTTPVersion(version) {
+				return fmt.Errorf("upstream %s: invalid HTTP version %q (want auto, h1, h2, h2c or h3)", up.Name, version)
+			}
+		}
+		if seen[up.Name] {
+			return fmt.Errorf("duplicate upstream name: %s", up.Name)
+		}
+		seen[up.Name] = true
+	}
+	return nil
+}
+
+func validHTTPVersion(version string) bool {
+	switch version {
+	case "", "auto", "h1", "h2", "h2c", "h3":
+		return true
+	}
+	return false
+}
+
+// ============================================================================
+// Upstream Pool
+// ============================================================================
+
+func newUpstreamPool(p *Proxy) (*upstreamPool, error) {
+	pool := &upstreamPool{policy: p.config.UpstreamPolicy, stop: make(chan struct{})}
+	for _, upCfg := range p.config.upstreamConfigs() {
+		up, err := newUpstream(p, upCfg)
+		if err != nil {
+			return nil, err
+		}
+		pool.upstreams = append(pool.upstreams, up)
+	}
+	return pool, nil
+}
+
+func newUpstream(p *Proxy, upCfg UpstreamConfig) (*upstream, error) {
+	parsedPOST, err := url.Parse(upCfg.URLPOST)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: invalid POST URL: %w", upCfg.Name, err)
+	}
+	parsedGET, err := url.Parse(upCfg.URLGET)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: invalid GET URL: %w", upCfg.Name, err)
+	}
+
+	httpVersionPOST := resolveHTTPVersion(upCfg.HTTPVersionPOST, parsedPOST.Scheme, false)
+	httpVersionGET := resolveHTTPVersion(upCfg.HTTPVersionGET, parsedGET.Scheme, true)
+	transportPOST, err := createTransport(p.config, p.verifier, p.clientCert, upCfg, parsedPOST, httpVersionPOST, false)
+	if err != nil {
+		return nil, err
+	}
+	var transportGET http.RoundTripper
+	if p.config.Version != 1 {
+		if transportGET, err = createTransport(p.config, p.verifier, p.clientCert, upCfg, parsedGET, httpVersionGET, true); err != nil {
+			return nil, err
+		}
+	}
+	if upCfg.AuthScheme == authHMAC {
+		transportPOST = hmacSigner{transportPOST, upCfg.AuthToken}
+		if transportGET != nil {
+			transportGET = hmacSigner{transportGET, upCfg.AuthToken}
+		}
+	}
+
+	up := &upstream{
+		config:          upCfg,
+		httpClientPOST:  &http.Client{Transport: transportPOST, Timeout: 0},
+		httpClientGET:   &http.Client{Transport: transportGET, Timeout: 0},
+		httpVersionPOST: httpVersionPOST,
+		httpVersionGET:  httpVersionGET,
+		metrics:         p.metrics,
+		healthy:         true,
+
+		fallbackCooldown: p.config.FallbackCooldown,
+	}
+	up.mux = &muxClient{proxy: p, upstream: up}
+	return up, nil
+}
+
+// pick selects an upstream for a new tunnel according to the configured
+// policy. When every upstream is unhealthy the first one is tried anyway.
+// An upstream pinned through the admin API overrides the policy.
+func (pool *upstreamPool) pick() *upstream {
+	if up := pool.pinned.Load(); up != nil {
+		return up
+	}
+
+	var healthy []*upstream
+	for _, up := range pool.upstreams {
+		if up.isHealthy() {
+			healthy = append(healthy, up)
+		}
+	}
+	if len(healthy) == 0 {
+		return pool.upstreams[0]
+	}
+
+	switch pool.policy {
+	case policyRoundRobin:
+		return healthy[(pool.next.Add(1)-1)%uint64(len(healthy))]
+	case policyLowestLatency:
+		best := healthy[0]
+		for _, up := range healthy[1:] {
+			if up.compareLatency(best) < 0 {
+				best = up
+			}
+		}
+		return best
+	default:
+		return healthy[0]
+	}
+}
+
+func (pool *upstreamPool) lookup(name string) *upstream {
+	for _, up := range pool.upstreams {
+		if up.config.Name == name {
+			return up
+		}
+	}
+	return nil
+}
+
+// pin makes every new tunnel use the named upstream; an empty name returns to
+// the selection policy.
+func (pool *upstreamPool) pin(name string) error {
+	if name == "" {
+		pool.pinned.Store(nil)
+		return nil
+	}
+	up := pool.lookup(name)
+	if up == nil {
+		return fmt.Errorf("unknown upstream: %s", name)
+	}
+	pool.pinned.Store(up)
+	return nil
+}
+
+// pinnedName returns the name of the pinned upstream, or "".
+func (pool *upstreamPool) pinnedName() string {
+	if up := pool.pinned.Load(); up != nil {
+		return up.config.Name
+	}
+	return ""
+}
+
+// checkHealth probes every upstream periodically and updates its state.
+func (pool *upstreamPool) checkHealth(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, up := range pool.upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				latency, err := up.probe(timeout)
+				if err != nil {
+					up.markUnhealthy(err)
+					return
+				}
+				up.markHealthy(latency)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ticker.C:
+		case <-pool.stop:
+			return
+		}
+	}
+}
+
+// close retires a pool replaced by a reload: health probing stops and mux
+// sessions end once the tunnels they carry have closed.
+func (pool *upstreamPool) close() {
+	close(pool.stop)
+	for _, up := range pool.upstreams {
+		up.mux.retire()
+	}
+}
+
+// ============================================================================
+// Upstream State
+// ============================================================================
+
+// probe sends an untargeted request with valid credentials. Servers answer it
+// with 400 (missing target), so any response other than 401 or 5xx means the
+// upstream is reachable and accepts our token. Health is decided by the POST
+// leg alone; a failing GET leg only counts towards the V1 fallback.
+func (up *upstream) probe(timeout time.Duration) (time.Duration, error) {
+	latency, err := up.probeURL(up.httpClientPOST, up.config.URLPOST, timeout)
+	if err != nil || up.httpClientGET.Transport == nil {
+		return latency, err
+	}
+	if _, err := up.probeURL(up.httpClientGET, up.config.URLGET, timeout); err != nil {
+		slog.Warn("GET probe failed", "upstream", up.config.Name, "error", err)
+		up.reportV2Failure()
+	}
+	return latency, nil
+}
+
+func (up *upstream) probeURL(client *http.Client, rawURL string, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	up.authorize(req)
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set(capabilityHeader, clientCapabilities)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("probe returned status: %s", resp.Status)
+	}
+	up.learnCapabilities(resp.Header)
+	return time.Since(start), nil
+}
+
+func (up *upstream) isHealthy() bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.healthy
+}
+
+// compareLatency orders measured latencies before unmeasured ones.
+func (up *upstream) compareLatency(other *upstream) int {
+	a, b := up.currentLatency(), other.currentLatency()
+	switch {
+	case a == b:
+		return 0
+	case a == 0:
+		return 1
+	case b == 0:
+		return -1
+	case a < b:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func (up *upstream) currentLatency() time.Duration {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.latency
+}
+
+func (up *upstream) markHealthy(latency time.Duration) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.latency = latency
+	up.failures = 0
+	up.lastError = ""
+	if !up.healthy {
+		up.healthy = true
+		slog.Info("Upstream is healthy again", "upstream", up.config.Name, "latency", latency.Round(time.Millisecond))
+	}
+}
+
+func (up *upstream) markUnhealthy(err error) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.lastError = err.Error()
+	if up.healthy {
+		up.healthy = false
+		slog.Warn("Upstream is unhealthy", "upstream", up.config.Name, "error", err)
+	}
+}
+
+// reportSuccess and reportFailure feed tunnel outcomes into the health state
+// so a failing upstream is skipped before the next probe. A tunnel that gets
+// through also restores health, which is the only way back without probes.
+func (up *upstream) reportSuccess() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.failures = 0
+	if !up.healthy {
+		up.healthy = true
+		up.lastError = ""
+		slog.Info("Upstream is healthy again", "upstream", up.config.Name)
+	}
+}
+
+func (up *upstream) reportFailure(err error) {
+	if isExpectedError(err) {
+		return
+	}
+	up.mu.Lock()
+	up.failures++
+	failures := up.failures
+	up.mu.Unlock()
+
+	if failures >= upstreamMaxFailures {
+		up.markUnhealthy(fmt.Errorf("%d consecutive failures, last: %w", failures, err))
+	}
+}
+
+// authorize sets the Authorization header for req using the upstream's
+// scheme. hmac requests are left to the hmacSigner transport, which signs
+// the target and session headers that setTunnelHeaders sends.
+func (up *upstream) authorize(req *http.Request) {
+	if up.config.AuthScheme != authHMAC {
+		req.Header.Set("Authorization", "Basic "+up.config.AuthToken)
+	}
+}
+
+func (up *upstream) setTunnelHeaders(req *http.Request, targetHost, targetPort, sessionID string) {
+	up.authorize(req)
+	if targetHost != "" {
+		req.Header.Set("X-Target-Host", targetHost)
+		req.Header.Set("X-Target-Port", targetPort)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Cache-Control", "no-cache")
+	req.Header.Set(capabilityHeader, clientCapabilities)
+	if sessionID != "" {
+		req.Header.Set("X-Session-ID", sessionID)
+	}
+}
+
+// errUpstreamStatus reports an unexpected upstream status code.
+func errUpstreamStatus(resp *http.Response) error {
+	return &upstreamStatusError{status: resp.Status, code: resp.StatusCode}
+}
+
+type upstreamStatusError struct {
+	status string
+	code   int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "upstream returned status: " + e.status
+}
+
+// ============================================================================
+// Protocol Negotiation
+// ============================================================================
+
+// negotiate probes the upstream once so its capabilities are known before
+// the first tunnel is opened.
+func (up *upstream) negotiate(timeout time.Duration) {
+	if _, err := up.probeURL(up.httpClientPOST, up.config.URLPOST, timeout); err != nil {
+		slog.Warn("Capability probe failed", "upstream", up.config.Name, "error", err)
+	}
+}
+
+// learnCapabilities records the versions advertised in a server response.
+// Servers that predate the header leave the capabilities unknown.
+func (up *upstream) learnCapabilities(h http.Header) {
+	value := h.Get(capabilityHeader)
+	if value == "" {
+		return
+	}
+	capabilities := make(map[string]bool)
+	for _, v := range strings.Split(value, ",") {
+		capabilities[strings.TrimSpace(v)] = true
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.capabilities == nil {
+		slog.Info("Upstream supports protocol versions", "upstream", up.config.Name, "versions", value)
+	}
+	up.capabilities = capabilities
+}
+
+func (up *upstream) supports(version string) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return up.capabilities == nil || up.capabilities[version]
+}
+
+// protocolVersion resolves the version to use for the next tunnel: the
+// configured version (0 = auto), downgraded to V1 when the server does not
+// advertise V2 or while a V2 fallback cooldown is active.
+func (up *upstream) protocolVersion(configured int) int {
+	if configured == 1 || !up.supports("2") {
+		return 1
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if up.fallbackUntil.IsZero() {
+		return 2
+	}
+	if time.Now().Before(up.fallbackUntil) {
+		return 1
+	}
+	up.fallbackUntil = time.Time{}
+	up.v2Failures = 0
+	slog.Info("V2 fallback cooldown expired, retrying V2", "upstream", up.config.Name)
+	return 2
+}
+
+// useMux reports whether tunnels to this upstream should be multiplexed.
+func (up *upstream) useMux(enabled bool) bool {
+	return enabled && up.supports("mux")
+}
+
+// usePacketUpload reports whether V2 uploads to this upstream should be sent
+// as packets; upstreams without packet support get a streaming POST.
+func (up *upstream) usePacketUpload(mode string) bool {
+	return mode == uploadModePacket && up.supports("packet")
+}
+
+// usePollDownload reports whether V2 downloads from this upstream should be
+// long-polled; upstreams without poll support get a streaming GET.
+func (up *upstream) usePollDownload(mode string) bool {
+	return mode == downloadModePoll && up.supports("poll")
+}
+
+// reportV2Failure counts V2 tunnels that could not be established. After
+// upstreamMaxFailures in a row the upstream falls back to V1 for cooldown.
+func (up *upstream) reportV2Failure() {
+	if up.fallbackCooldown <= 0 {
+		return
+	}
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.v2Failures++
+	if up.v2Failures >= upstreamMaxFailures && up.fallbackUntil.IsZero() {
+		up.fallbackUntil = time.Now().Add(up.fallbackCooldown)
+		slog.Warn("V2 failed repeatedly, falling back to V1", "upstream", up.config.Name, "failures", up.v2Failures, "cooldown", up.fallbackCooldown)
+	}
+}
+
+func (up *upstream) reportV2Success() {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.v2Failures = 0
+}
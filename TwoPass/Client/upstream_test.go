@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUpstreamHealthFromTunnels(t *testing.T) {
+	up := &upstream{config: UpstreamConfig{Name: "a"}, healthy: true}
+	pool := &upstreamPool{policy: policyRoundRobin, upstreams: []*upstream{{config: UpstreamConfig{Name: "b"}, healthy: true}, up}}
+	failure := errors.New("connection refused")
+
+	steps := []struct {
+		name        string
+		report      func()
+		wantHealthy bool
+	}{
+		{"first failure", func() { up.reportFailure(failure) }, true},
+		{"second failure", func() { up.reportFailure(failure) }, true},
+		{"expected errors do not count", func() { up.reportFailure(context.Canceled) }, true},
+		{"third failure", func() { up.reportFailure(failure) }, false},
+		{"more failures", func() { up.reportFailure(failure) }, false},
+		// Without health probes, a tunnel that gets through is the way back.
+		{"success", up.reportSuccess, true},
+		{"failure count restarted", func() { up.reportFailure(failure); up.reportFailure(failure) }, true},
+	}
+	for _, step := range steps {
+		step.report()
+		if got := up.isHealthy(); got != step.wantHealthy {
+			t.Fatalf("%s: healthy = %v, want %v", step.name, got, step.wantHealthy)
+		}
+		picked := false
+		for range len(pool.upstreams) {
+			if pool.pick() == up {
+				picked = true
+			}
+		}
+		if picked != step.wantHealthy {
+			t.Errorf("%s: picked = %v, want %v", step.name, picked, step.wantHealthy)
+		}
+	}
+}
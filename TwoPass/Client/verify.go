@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ============================================================================
+// Certificate Verification
+// ============================================================================
+//
+// By default the client trusts the system store, or nothing at all with
+// -insecure. A certVerifier adds three independent checks, all performed in
+// VerifyPeerCertificate so they apply identically to h1, h2 and h3:
+//
+//   - chain verification against a custom CA bundle (-ca-file)
+//   - SPKI SHA-256 pins; any certificate in the chain may match, as long as
+//     the certificates before it are signed by their successors (-pin)
+//   - trust on first use, recording the leaf key per host (-tofu-file)
+
+const pinPrefix = "sha256/"
+
+type certVerifier struct {
+	insecure bool
+	roots    *x509.CertPool // nil = system store
+	pins     map[string]bool
+	tofu     *tofuStore
+}
+
+func newCertVerifier(cfg Config) (*certVerifier, error) {
+	v := &certVerifier{insecure: cfg.InsecureSkipVerify}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+	}
+
+	for _, pin := range cfg.Pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q (want sha256/<base64 SPKI hash>)", pin)
+		}
+		if v.pins == nil {
+			v.pins = make(map[string]bool)
+		}
+		v.pins[base64.StdEncoding.EncodeToString(hash)] = true
+	}
+
+	if cfg.TOFUFile != "" {
+		store, err := loadTOFUStore(cfg.TOFUFile)
+		if err != nil {
+			return nil, err
+		}
+		v.tofu = store
+	}
+	return v, nil
+}
+
+// custom reports whether any check beyond the standard library's is configured.
+func (v *certVerifier) custom() bool {
+	return v.roots != nil || v.pins != nil || v.tofu != nil
+}
+
+// tlsConfig returns the client TLS configuration for one upstream direction.
+// serverName is the name the certificate must carry; addr keys the TOFU store.
+func (v *certVerifier) tlsConfig(sni, serverName, addr string) *tls.Config {
+	if !v.custom() {
+		return &tls.Config{ServerName: sni, InsecureSkipVerify: v.insecure}
+	}
+
+	// Chain verification is done here so it can use our own roots, and so
+	// that pins and TOFU still apply when -insecure skips it.
+	verifyChain := v.roots != nil || !v.insecure
+	return &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("parse certificate from %s: %w", addr, err)
+				}
+				certs[i] = cert
+			}
+			if len(certs) == 0 {
+				return fmt.Errorf("no certificate presented by %s", addr)
+			}
+
+			var chains [][]*x509.Certificate
+			if verifyChain {
+				opts := x509.VerifyOptions{
+					Roots:         v.roots,
+					DNSName:       serverName,
+					Intermediates: x509.NewCertPool(),
+				}
+				for _, cert := range certs[1:] {
+					opts.Intermediates.AddCert(cert)
+				}
+				var err error
+				if chains, err = certs[0].Verify(opts); err != nil {
+					return fmt.Errorf("certificate for %s not trusted: %w", addr, err)
+				}
+			}
+
+			if v.pins != nil && !v.matchesPin(certs, chains) {
+				return fmt.Errorf("certificate pin mismatch for %s: got %s%s, which is not among the %d configured pins",
+					addr, pinPrefix, spkiHash(certs[0]), len(v.pins))
+			}
+
+			if v.tofu != nil {
+				return v.tofu.check(addr, spkiHash(certs[0]))
+			}
+			return nil
+		},
+	}
+}
+
+// matchesPin looks for a pinned key in the verified chains or, when the chain
+// was not verified, in the presented certificates. A presented certificate
+// past the leaf only counts if each one before it is signed by the next;
+// otherwise anyone could append a public intermediate to their own leaf.
+func (v *certVerifier) matchesPin(certs []*x509.Certificate, chains [][]*x509.Certificate) bool {
+	if chains != nil {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if v.pins[spkiHash(cert)] {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for i, cert := range certs {
+		if i > 0 && certs[i-1].CheckSignatureFrom(cert) != nil {
+			return false
+		}
+		if v.pins[spkiHash(cert)] {
+			return true
+		}
+	}
+	return false
+}
+
+// spkiHash is the base64 SHA-256 of the certificate's SubjectPublicKeyInfo,
+// as printed by `openssl x509 -pubkey | openssl pkey -pubin -outform der |
+// openssl dgst -sha256 -binary | base64`.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ============================================================================
+// Trust-On-First-Use Store
+// ============================================================================
+
+// tofuStore is a known_hosts style file of "host:port sha256/<hash>" lines.
+type tofuStore struct {
+	path  string
+	mu    sync.Mutex
+	known map[string]string
+}
+
+func loadTOFUStore(path string) (*tofuStore, error) {
+	t := &tofuStore{path: path, known: make(map[string]string)}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open TOFU file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addr, pin, ok := strings.Cut(line, " ")
+		if !ok || !strings.HasPrefix(pin, pinPrefix) {
+			return nil, fmt.Errorf("%s:%d: invalid entry (want host:port sha256/<hash>)", path, lineNo)
+		}
+		t.known[addr] = strings.TrimPrefix(strings.TrimSpace(pin), pinPrefix)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read TOFU file: %w", err)
+	}
+	return t, nil
+}
+
+func (t *tofuStore) check(addr, hash string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if known, ok := t.known[addr]; ok {
+		if known != hash {
+			return fmt.Errorf("certificate for %s changed: known %s%s, got %s%s (remove the entry from %s if the change is expected)",
+				addr, pinPrefix, known, pinPrefix, hash, t.path)
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(t.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("record certificate for %s: %w", addr, err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s%s\n", addr, pinPrefix, hash); err != nil {
+		return fmt.Errorf("record certificate for %s: %w", addr, err)
+	}
+	t.known[addr] = hash
+	slog.Info("Trusting certificate on first use", "addr", addr, "pin", pinPrefix+hash)
+	return nil
+}
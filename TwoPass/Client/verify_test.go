@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate for name, signed by parent or self-signed
+// when parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func TestCertVerifierPins(t *testing.T) {
+	root := newTestCert(t, "Test Root", true, nil)
+	inter := newTestCert(t, "Test Intermediate", true, root)
+	leaf := newTestCert(t, "upstream.example", false, inter)
+	// The attacker owns their leaf, and can send anyone's public intermediate
+	// and root along with it.
+	attacker := newTestCert(t, "upstream.example", false, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		pin     *testCert
+		chain   []*testCert
+		wantErr string
+	}{
+		{name: "leaf pin", pin: leaf, chain: []*testCert{leaf}},
+		{name: "intermediate pin", pin: inter, chain: []*testCert{leaf, inter}},
+		{name: "root pin", pin: root, chain: []*testCert{leaf, inter, root}},
+		{name: "other key", pin: root, chain: []*testCert{leaf}, wantErr: "pin mismatch"},
+		{name: "appended intermediate", pin: inter, chain: []*testCert{attacker, inter}, wantErr: "pin mismatch"},
+		{name: "appended chain", pin: root, chain: []*testCert{attacker, inter, root}, wantErr: "pin mismatch"},
+		{name: "gap in chain", pin: root, chain: []*testCert{leaf, root}, wantErr: "pin mismatch"},
+		{name: "verified root pin", cfg: Config{CAFile: caFile}, pin: root, chain: []*testCert{leaf, inter}},
+		{name: "verified appended intermediate", cfg: Config{CAFile: caFile}, pin: inter, chain: []*testCert{attacker, inter}, wantErr: "not trusted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.InsecureSkipVerify = cfg.CAFile == ""
+			cfg.Pins = []string{pinPrefix + spkiHash(tt.pin.cert)}
+			v, err := newCertVerifier(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw := make([][]byte, len(tt.chain))
+			for i, c := range tt.chain {
+				raw[i] = c.cert.Raw
+			}
+			err = v.tlsConfig("front.example", "upstream.example", "upstream.example:443").VerifyPeerCertificate(raw, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("VerifyPeerCertificate = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("VerifyPeerCertificate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewCertVerifierInvalidPin(t *testing.T) {
+	for _, pin := range []string{"sha256/not base64", "sha256/AAAA", ""} {
+		if _, err := newCertVerifier(Config{Pins: []string{pin}}); err == nil {
+			t.Errorf("newCertVerifier accepted pin %q", pin)
+		}
+	}
+}
+
+func TestTOFUStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known")
+	store, err := loadTOFUStore(path)
+	if err != nil {
+		t.Fatalf("load missing file: %v", err)
+	}
+
+	steps := []struct {
+		name    string
+		addr    string
+		hash    string
+		wantErr string
+	}{
+		{name: "first use", addr: "a.example:443", hash: "AAAA"},
+		{name: "same key", addr: "a.example:443", hash: "AAAA"},
+		{name: "changed key", addr: "a.example:443", hash: "BBBB", wantErr: "certificate for a.example:443 changed"},
+		{name: "other host", addr: "b.example:443", hash: "BBBB"},
+	}
+	for _, step := range steps {
+		err := store.check(step.addr, step.hash)
+		if step.wantErr == "" && err != nil {
+			t.Errorf("%s: check = %v, want nil", step.name, err)
+		}
+		if step.wantErr != "" && (err == nil || !strings.Contains(err.Error(), step.wantErr)) {
+			t.Errorf("%s: check = %v, want an error containing %q", step.name, err, step.wantErr)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a.example:443 sha256/AAAA\nb.example:443 sha256/BBBB\n"; string(data) != want {
+		t.Errorf("TOFU file = %q, want %q", data, want)
+	}
+
+	// A new process trusts what the last one recorded.
+	reloaded, err := loadTOFUStore(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if err := reloaded.check("a.example:443", "BBBB"); err == nil {
+		t.Error("reloaded store accepted a changed key")
+	}
+	if err := reloaded.check("b.example:443", "BBBB"); err != nil {
+		t.Errorf("reloaded store rejected a known key: %v", err)
+	}
+}
+
+func TestLoadTOFUStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known")
+	if err := os.WriteFile(path, []byte("# comment\n\na.example:443 sha256/AAAA\nb.example:443 AAAA\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadTOFUStore(path)
+	if err == nil || !strings.Contains(err.Error(), path+":4: invalid entry") {
+		t.Errorf("loadTOFUStore = %v, want an invalid entry error for line 4", err)
+	}
+}
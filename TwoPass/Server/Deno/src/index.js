@@ -2,6 +2,8 @@
 const PASSWORD = Deno.env.get('PASSWORD');
 const HOSTNAME = Deno.env.get('HOSTNAME') || '0.0.0.0';
 const PORT = parseInt(Deno.env.get('PORT') || '8080', 10);
+const AUTH_MODE = Deno.env.get('AUTH_MODE') || 'any';
+const AUTH_WINDOW = parseInt(Deno.env.get('AUTH_WINDOW') || '60', 10);
 
 const STATUS = {
   OK: 200,
@@ -12,13 +14,114 @@ const STATUS = {
   BAD_GATEWAY: 502,
 };
 
+// Protocol versions advertised to authenticated clients
+const CAPABILITY_HEADERS = {
+  'X-TwoPass-Versions': '1,2',
+};
+
 const HEADERS = {
   'Content-Type': 'application/grpc',
   'Cache-Control': 'no-cache',
+  ...CAPABILITY_HEADERS,
 };
 
 const sessions = new Map();
 
+// Authentication: 'basic' (raw token), 'hmac' (signed, time-limited) or 'any'
+const HMAC_SCHEME = 'TwoPass-HMAC';
+const encoder = new TextEncoder();
+const hmacKeys = new Map();
+// Nonces live in this isolate only. Requests served by another isolate or
+// region do not see them, so replay protection is best-effort here; the
+// timestamp window still bounds how long a captured request stays usable.
+const seenNonces = new Map();
+
+function hmacKey(password) {
+  if (!hmacKeys.has(password)) {
+    hmacKeys.set(password, crypto.subtle.importKey(
+      'raw', encoder.encode(password), { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']
+    ));
+  }
+  return hmacKeys.get(password);
+}
+
+function base64url(buffer) {
+  return btoa(String.fromCharCode(...new Uint8Array(buffer)))
+    .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+/**
+ * Compares two strings in constant time, so a mismatch does not reveal how
+ * many leading characters were right
+ * @param {string} a - Received value
+ * @param {string} b - Expected value
+ * @returns {boolean} Whether the strings are equal
+ */
+function timingSafeEqual(a, b) {
+  const x = encoder.encode(a);
+  const y = encoder.encode(b);
+  let diff = x.length ^ y.length;
+  for (let i = 0; i < y.length; i++) {
+    diff |= (x[i] ?? 0) ^ y[i];
+  }
+  return diff === 0;
+}
+
+/**
+ * Verifies the Authorization header of a tunnel request
+ * @param {Request} request - Incoming HTTP request
+ * @param {string} password - Shared authentication token
+ * @param {string} mode - Accepted schemes: basic, hmac or any
+ * @param {number} windowSeconds - Maximum clock difference for HMAC signatures
+ * @returns {string|null} Rejection reason, or null when authorized
+ */
+async function authenticate(request, password, mode, windowSeconds) {
+  const header = request.headers.get('Authorization') || '';
+  const [scheme, params = ''] = header.split(' ', 2);
+
+  if (scheme === 'Basic' && mode !== 'hmac') {
+    return timingSafeEqual(header, `Basic ${password}`) ? null : 'invalid credentials';
+  }
+  if (scheme !== HMAC_SCHEME || mode === 'basic') {
+    return 'missing or malformed credentials';
+  }
+
+  const fields = Object.fromEntries(params.split(',').map(field => field.trim().split('=', 2)));
+  const ts = parseInt(fields.ts, 10);
+  if (!ts || !fields.nonce || !fields.sig) {
+    return 'missing or malformed credentials';
+  }
+
+  const message = [
+    request.method,
+    new URL(request.url).pathname,
+    request.headers.get('X-Target-Host') || '',
+    request.headers.get('X-Target-Port') || '',
+    request.headers.get('X-Session-ID') || '',
+    request.headers.get('X-Seq') || '',
+    request.headers.get('X-Offset') || '',
+    fields.ts,
+    fields.nonce,
+  ].join('\n');
+  const sig = base64url(await crypto.subtle.sign('HMAC', await hmacKey(password), encoder.encode(message)));
+  if (!timingSafeEqual(fields.sig, sig)) {
+    return 'invalid credentials';
+  }
+
+  const now = Math.floor(Date.now() / 1000);
+  if (Math.abs(now - ts) > windowSeconds) {
+    return 'signature timestamp outside the auth window';
+  }
+  for (const [nonce, expiry] of seenNonces) {
+    if (expiry < now) seenNonces.delete(nonce);
+  }
+  if (seenNonces.has(fields.nonce)) {
+    return 'signature nonce already used';
+  }
+  seenNonces.set(fields.nonce, ts + windowSeconds);
+  return null;
+}
+
 /**
  * TCPSession class for managing persistent TCP connections in V2 protocol
  */
@@ -134,10 +237,11 @@ console.log(`[*] TCP Tunnel Server starting on ${HOSTNAME}:${PORT}`);
 Deno.serve({
   hostname: HOSTNAME,
   port: PORT,
-  handler(request) {
+  async handler(request) {
     // Validate authentication
-    if (request.headers.get('Authorization') !== `Basic ${PASSWORD}`) {
-      console.log('[!] Unauthorized request');
+    const authError = await authenticate(request, PASSWORD, AUTH_MODE, AUTH_WINDOW);
+    if (authError) {
+      console.log(`[!] Unauthorized request: ${authError}`);
       return new Response('Unauthorized', { status: STATUS.UNAUTHORIZED });
     }
 
@@ -145,13 +249,19 @@ Deno.serve({
     const targetHost = request.headers.get('X-Target-Host')?.toLowerCase().trim();
     if (!targetHost || !/^[\w\-.:[\]]+$/.test(targetHost)) {
       console.log(`[!] Invalid target host: ${targetHost}`);
-      return new Response('Invalid target host', { status: STATUS.BAD_REQUEST });
+      return new Response('Invalid target host', {
+        status: STATUS.BAD_REQUEST,
+        headers: CAPABILITY_HEADERS,
+      });
     }
 
     const targetPort = parseInt(request.headers.get('X-Target-Port'), 10);
     if (!targetPort || targetPort < 1 || targetPort > 65535) {
       console.log(`[!] Invalid target port: ${targetPort}`);
-      return new Response('Invalid target port', { status: STATUS.BAD_REQUEST });
+      return new Response('Invalid target port', {
+        status: STATUS.BAD_REQUEST,
+        headers: CAPABILITY_HEADERS,
+      });
     }
 
     const sessionId = request.headers.get('X-Session-ID');